@@ -0,0 +1,181 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// AIFF and AIFF-C format specification
+// https://www.mmsp.ece.mcgill.ca/Documents/AudioFormats/AIFF/AIFF.html
+
+// AiffInfo Stream properties of an aiff file.
+type AiffInfo struct {
+	Compressed      bool   // the file is AIFF-C
+	CompressionType string // AIFF-C compression type, e.g. NONE, sowt, fl32, ima4
+	CompressionName string
+	Channels        uint16
+	SampleFrames    uint64
+	SampleSize      uint16 // bits per sample
+	SampleRate      float64
+	SoundOffset     uint32 // offset of the first sample frame in SSND data
+	SoundBlockSize  uint32
+	SoundDataSize   uint64 // size of SSND sound data after the offset
+	Duration        float64
+}
+
+// aiffMaxCommSize Upper limit of the COMM chunk read into memory.
+const aiffMaxCommSize = 64 << 10
+
+// parseExtended Convert an 80-bit IEEE 754 extended precision number.
+func parseExtended(b []byte) float64 {
+	sign := 1.0
+	if b[0]&0x80 != 0 {
+		sign = -1.0
+	}
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	return sign * math.Ldexp(float64(mantissa), exponent-16383-63)
+}
+
+// aiffFramesPerPacket Sample frames per packet of compression types where
+// the COMM frame count is a packet count.
+func aiffFramesPerPacket(compressionType string) uint64 {
+	switch compressionType {
+	case "ima4":
+		return 64
+	}
+	return 1
+}
+
+// Aiff Calculate aiff and aiff-c files duration.
+func Aiff(r io.ReadSeeker) (float64, error) {
+	info, err := ParseAiff(r)
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
+}
+
+// ParseAiff Parse the FORM container of AIFF or AIFF-C with COMM and SSND
+// chunks.
+func ParseAiff(r io.ReadSeeker) (AiffInfo, error) {
+	var info AiffInfo
+	buf := make([]byte, 12)
+
+	// FORM header
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return info, err
+	}
+	if string(buf[0:4]) != "FORM" {
+		return info, errors.New("not FORM")
+	}
+	switch string(buf[8:12]) {
+	case "AIFF":
+	case "AIFC":
+		info.Compressed = true
+	default:
+		return info, errors.New("not AIFF")
+	}
+
+	hasComm := false
+	hasSsnd := false
+	hdr := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(r, hdr)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return info, err
+		}
+		chunkID := string(hdr[0:4])
+		chunkSize := binary.BigEndian.Uint32(hdr[4:8])
+
+		switch chunkID {
+		case "COMM":
+			// numChannels (2), numSampleFrames (4), sampleSize (2), sampleRate (10)
+			// AIFF-C: compressionType (4), compressionName (pstring)
+			if chunkSize > aiffMaxCommSize {
+				return info, errors.New("COMM chunk too large")
+			}
+			commBuf := make([]byte, chunkSize)
+			_, err = io.ReadFull(r, commBuf)
+			if err != nil {
+				return info, err
+			}
+			if len(commBuf) < 18 {
+				return info, errors.New("invalid COMM chunk")
+			}
+			info.Channels = binary.BigEndian.Uint16(commBuf[0:2])
+			info.SampleFrames = uint64(binary.BigEndian.Uint32(commBuf[2:6]))
+			info.SampleSize = binary.BigEndian.Uint16(commBuf[6:8])
+			info.SampleRate = parseExtended(commBuf[8:18])
+			if info.Compressed && len(commBuf) >= 22 {
+				info.CompressionType = string(commBuf[18:22])
+				if len(commBuf) > 22 {
+					n := int(commBuf[22])
+					if 23+n <= len(commBuf) {
+						info.CompressionName = string(commBuf[23 : 23+n])
+					}
+				}
+			}
+			hasComm = true
+		case "SSND":
+			// offset (4), blockSize (4), sound data
+			if chunkSize < 8 {
+				return info, errors.New("invalid SSND chunk")
+			}
+			_, err = io.ReadFull(r, buf[0:8])
+			if err != nil {
+				return info, err
+			}
+			info.SoundOffset = binary.BigEndian.Uint32(buf[0:4])
+			info.SoundBlockSize = binary.BigEndian.Uint32(buf[4:8])
+			if uint64(chunkSize) >= 8+uint64(info.SoundOffset) {
+				info.SoundDataSize = uint64(chunkSize) - 8 - uint64(info.SoundOffset)
+			}
+			hasSsnd = true
+			_, err = r.Seek(int64(chunkSize)-8, io.SeekCurrent)
+			if err != nil {
+				return info, err
+			}
+		default:
+			_, err = r.Seek(int64(chunkSize), io.SeekCurrent)
+			if err != nil {
+				return info, err
+			}
+		}
+		// Chunks are word aligned
+		if chunkSize%2 == 1 {
+			_, err = r.Seek(1, io.SeekCurrent)
+			if err != nil {
+				return info, err
+			}
+		}
+	}
+
+	if !hasComm {
+		return info, errors.New("missing COMM chunk")
+	}
+	if info.SampleRate <= 0 {
+		return info, errors.New("invalid sample rate")
+	}
+	frames := info.SampleFrames * aiffFramesPerPacket(info.CompressionType)
+	// Streaming writers may leave the frame count zero; derive it from the
+	// sound data of uncompressed files.
+	uncompressed := !info.Compressed || info.CompressionType == "NONE" || info.CompressionType == "sowt"
+	if frames == 0 && hasSsnd && uncompressed && info.Channels != 0 {
+		frameSize := uint64(info.Channels) * uint64((info.SampleSize+7)/8)
+		if frameSize != 0 {
+			frames = info.SoundDataSize / frameSize
+		}
+	}
+	info.Duration = float64(frames) / info.SampleRate
+	return info, nil
+}
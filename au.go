@@ -0,0 +1,86 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Sun/NeXT audio file format
+// https://www.mmsp.ece.mcgill.ca/Documents/AudioFormats/AU/AU.html
+
+// auUnknownSize The data size of files written by streaming writers.
+const auUnknownSize = 0xFFFFFFFF
+
+// auBitsPerSample Lookup bits per sample of au encodings.
+func auBitsPerSample(encoding uint32) uint32 {
+	switch encoding {
+	case 1, 2, 27: // 8-bit u-law, 8-bit linear, 8-bit A-law
+		return 8
+	case 3: // 16-bit linear
+		return 16
+	case 4: // 24-bit linear
+		return 24
+	case 5, 6: // 32-bit linear, 32-bit float
+		return 32
+	case 7: // 64-bit float
+		return 64
+	case 23: // G.721 4-bit ADPCM
+		return 4
+	case 25: // G.723 3-bit ADPCM
+		return 3
+	case 26: // G.723 5-bit ADPCM
+		return 5
+	}
+	return 0
+}
+
+// Au Calculate au/snd files duration.
+func Au(r io.ReadSeeker) (float64, error) {
+	// magic (4), data offset (4), data size (4), encoding (4), sample rate (4), channels (4)
+	buf := make([]byte, 24)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+	if string(buf[0:4]) != ".snd" {
+		return 0, errors.New("not valid au file")
+	}
+	dataOffset := binary.BigEndian.Uint32(buf[4:8])
+	dataSize := uint64(binary.BigEndian.Uint32(buf[8:12]))
+	encoding := binary.BigEndian.Uint32(buf[12:16])
+	sampleRate := binary.BigEndian.Uint32(buf[16:20])
+	channels := binary.BigEndian.Uint32(buf[20:24])
+
+	bits := auBitsPerSample(encoding)
+	if bits == 0 {
+		return 0, errors.New("unsupported au encoding")
+	}
+	if sampleRate == 0 || channels == 0 {
+		return 0, errors.New("invalid au header")
+	}
+	// the header is 24 bytes, followed by an optional annotation
+	if dataOffset < 24 {
+		return 0, errors.New("invalid au data offset")
+	}
+	frameBits := uint64(bits) * uint64(channels)
+	if frameBits == 0 {
+		return 0, errors.New("invalid au header")
+	}
+	if dataSize == auUnknownSize {
+		// The data extends to the end of file
+		start, err := r.Seek(-24, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		end, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		if end-start < int64(dataOffset) {
+			return 0, errors.New("invalid au data offset")
+		}
+		dataSize = uint64(end - start - int64(dataOffset))
+	}
+	return float64(dataSize*8) / float64(frameBits) / float64(sampleRate), nil
+}
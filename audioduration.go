@@ -15,6 +15,10 @@ const (
 	TypeWav  int = 5
 	TypeAac  int = 6
 	TypeWebM int = 7
+	TypeAiff int = 8
+	TypeCaf  int = 9
+	TypeAu   int = 10
+	TypeVoc  int = 11
 )
 
 // Duration Get duration of specific music file type.
@@ -39,6 +43,14 @@ func Duration(file io.ReadSeeker, filetype int) (float64, error) {
 		d, err = AAC(file)
 	case TypeWebM:
 		d, err = WebM(file)
+	case TypeAiff:
+		d, err = Aiff(file)
+	case TypeCaf:
+		d, err = Caf(file)
+	case TypeAu:
+		d, err = Au(file)
+	case TypeVoc:
+		d, err = Voc(file)
 	default:
 		err = fmt.Errorf("unsupported type: %d", filetype)
 	}
@@ -1,7 +1,12 @@
 package audioduration
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"testing"
@@ -30,6 +35,18 @@ func TestFLAC(t *testing.T) {
 	if math.Abs(d-sampleDuration) > delta {
 		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, d)
 	}
+
+	// total samples is a 36-bit field, set its most significant bit
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Sample FLAC file(%s): %s.\n", testFile, err)
+	}
+	data[8+13] = data[8+13]&0xf0 | 0x08
+	copy(data[8+14:8+18], []byte{0, 0, 0, 0})
+	d, err = FLAC(bytes.NewReader(data))
+	if err != nil || d != float64(1<<35)/11025 {
+		t.Errorf("expected '%v', found '%v' (%v)\n", float64(1<<35)/11025, d, err)
+	}
 }
 
 func TestMp4(t *testing.T) {
@@ -185,3 +202,1264 @@ func TestWebM(t *testing.T) {
 		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, d)
 	}
 }
+
+func TestVerifyFLAC(t *testing.T) {
+	testFile := "samples/sample.flac"
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Sample FLAC file(%s): %s.\n", testFile, err)
+	}
+	v, err := VerifyFLAC(bytes.NewReader(data))
+	fmt.Println(v.Frames, v.BadFrames, v.EndSample, v.TotalSamples)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if !v.Valid() || v.Frames == 0 {
+		t.Errorf("expected valid flac, found %+v\n", v)
+	}
+
+	// Corrupt a byte in the middle of the audio frames
+	data[len(data)/2] ^= 0x55
+	v, err = VerifyFLAC(bytes.NewReader(data))
+	fmt.Println(v.Frames, v.BadFrames, v.EndSample, v.TotalSamples)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if len(v.BadFrames) != 1 {
+		t.Errorf("expected 1 bad frame, found %v\n", v.BadFrames)
+	}
+}
+
+func TestParseFLAC(t *testing.T) {
+	seek := make([]byte, 18*3)
+	binary.BigEndian.PutUint64(seek[0:8], 0)
+	binary.BigEndian.PutUint64(seek[8:16], 0)
+	binary.BigEndian.PutUint16(seek[16:18], 1152)
+	binary.BigEndian.PutUint64(seek[18:26], 5512)
+	binary.BigEndian.PutUint64(seek[26:34], 12345)
+	binary.BigEndian.PutUint16(seek[34:36], 1152)
+	binary.BigEndian.PutUint64(seek[36:44], 0xFFFFFFFFFFFFFFFF)
+
+	cue := make([]byte, 396)
+	copy(cue, "1234567890123")
+	cue[395] = 3
+	addTrack := func(offset uint64, num byte, indices ...uint64) {
+		tr := make([]byte, 36)
+		binary.BigEndian.PutUint64(tr[0:8], offset)
+		tr[8] = num
+		tr[35] = byte(len(indices))
+		cue = append(cue, tr...)
+		for i, off := range indices {
+			idx := make([]byte, 12)
+			binary.BigEndian.PutUint64(idx[0:8], off)
+			idx[8] = byte(i + 1)
+			cue = append(cue, idx...)
+		}
+	}
+	addTrack(0, 1, 0)
+	addTrack(11025, 2, 0)
+	addTrack(37478, 255)
+
+	data := flacWithBlocks(t, map[byte][]byte{3: seek, 5: cue}, []byte{3, 5})
+	info, err := ParseFLAC(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if math.Abs(info.Duration-3.399365) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", 3.399365, info.Duration)
+	}
+	if len(info.SeekPoints) != 2 {
+		t.Errorf("expected 2 seek points, found %v\n", info.SeekPoints)
+	}
+	sample, offset, ok := info.SeekOffset(0.75)
+	if !ok || sample != 5512 || offset != info.FirstFrameOffset+12345 {
+		t.Errorf("unexpected seek result %v %v %v\n", sample, offset, ok)
+	}
+	if info.CueSheet == nil || len(info.CueSheet.Tracks) != 2 {
+		t.Fatalf("expected 2 cue tracks, found %+v\n", info.CueSheet)
+	}
+	if info.CueSheet.MediaCatalogNumber != "1234567890123" {
+		t.Errorf("unexpected catalog number %q\n", info.CueSheet.MediaCatalogNumber)
+	}
+	if math.Abs(info.CueSheet.Tracks[0].Duration-1) > delta ||
+		math.Abs(info.CueSheet.Tracks[1].Duration-2.399365) > delta {
+		t.Errorf("unexpected track durations %+v\n", info.CueSheet.Tracks)
+	}
+
+	// the duration only needs STREAMINFO, a broken cuesheet is not read
+	broken := flacWithBlocks(t, map[byte][]byte{5: make([]byte, 10)}, []byte{5})
+	d, err := FLAC(bytes.NewReader(broken))
+	if err != nil || math.Abs(d-3.399365) > delta {
+		t.Errorf("unexpected duration %v (%v)\n", d, err)
+	}
+	if _, err := ParseFLAC(bytes.NewReader(broken)); err == nil {
+		t.Errorf("expected error on broken cuesheet\n")
+	}
+}
+
+func TestOggFLAC(t *testing.T) {
+	data, err := os.ReadFile("samples/sample.flac")
+	if err != nil {
+		t.Fatalf("Sample FLAC file: %s.\n", err)
+	}
+	ident := []byte("\x7FFLAC\x01\x00\x00\x01fLaC")
+	ident = append(ident, data[4:42]...)
+	comment := []byte{0x84, 0, 0, 8}
+	comment = append(comment, make([]byte, 8)...)
+
+	var ogg []byte
+	ogg = append(ogg, oggPage(1, 0, 0, 0x02, ident)...)
+	ogg = append(ogg, oggPage(1, 1, 0, 0, comment)...)
+	ogg = append(ogg, oggPage(1, 2, 20000, 0, make([]byte, 300))...)
+	ogg = append(ogg, oggPage(1, 3, 37478, 0x04, make([]byte, 300))...)
+
+	var sampleDuration float64 = 3.399365
+	d, err := FLAC(bytes.NewReader(ogg))
+	fmt.Println(sampleDuration, d)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if math.Abs(d-sampleDuration) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, d)
+	}
+
+	// Ogg streams of other codecs are not flac
+	vorbis, err := os.ReadFile("samples/example.ogg")
+	if err != nil {
+		t.Fatalf("Sample OGG file: %s.\n", err)
+	}
+	if _, err := FLAC(bytes.NewReader(vorbis)); err == nil {
+		t.Errorf("expected error on ogg vorbis\n")
+	}
+}
+
+func TestOpus(t *testing.T) {
+	head := []byte("OpusHead\x01\x02")
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 44100)
+	head = append(head, 0, 0, 0)
+
+	var ogg []byte
+	ogg = append(ogg, oggPage(7, 0, 0, 0x02, head)...)
+	ogg = append(ogg, oggPage(7, 1, 0, 0, []byte("OpusTags\x00\x00\x00\x00\x00\x00\x00\x00"))...)
+	ogg = append(ogg, oggPage(7, 2, 48000, 0, make([]byte, 100))...)
+	ogg = append(ogg, oggPage(7, 3, 96312, 0x04, make([]byte, 100))...)
+
+	var sampleDuration float64 = 2
+	info, err := ParseOgg(bytes.NewReader(ogg))
+	fmt.Println(sampleDuration, info.Duration)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if info.Codec != "opus" || info.InputSampleRate != 44100 || info.PreSkip != 312 || info.Channels != 2 {
+		t.Errorf("unexpected opus info %+v\n", info)
+	}
+	if math.Abs(info.Duration-sampleDuration) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, info.Duration)
+	}
+}
+
+func TestOggSpeexWithTheora(t *testing.T) {
+	speex := make([]byte, 80)
+	copy(speex, "Speex   ")
+	binary.LittleEndian.PutUint32(speex[36:40], 16000)
+	binary.LittleEndian.PutUint32(speex[48:52], 1)
+	theora := make([]byte, 42)
+	copy(theora, "\x80theora")
+
+	var ogg []byte
+	ogg = append(ogg, oggPage(100, 0, 0, 0x02, theora)...)
+	ogg = append(ogg, oggPage(200, 0, 0, 0x02, speex)...)
+	ogg = append(ogg, oggPage(200, 1, 16000, 0, make([]byte, 50))...)
+	ogg = append(ogg, oggPage(100, 1, 0x7fffffff, 0, make([]byte, 50))...)
+	ogg = append(ogg, oggPage(200, 2, 48000, 0x04, make([]byte, 50))...)
+	ogg = append(ogg, oggPage(100, 2, 0xffffffff, 0x04, make([]byte, 50))...)
+
+	var sampleDuration float64 = 3
+	info, err := ParseOgg(bytes.NewReader(ogg))
+	fmt.Println(sampleDuration, info.Duration)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if info.Codec != "speex" || info.SampleRate != 16000 || info.Channels != 1 {
+		t.Errorf("unexpected speex info %+v\n", info)
+	}
+	if math.Abs(info.Duration-sampleDuration) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, info.Duration)
+	}
+}
+
+func TestOggChained(t *testing.T) {
+	opus := []byte("OpusHead\x01\x01")
+	opus = binary.LittleEndian.AppendUint16(opus, 312)
+	opus = binary.LittleEndian.AppendUint32(opus, 48000)
+	opus = append(opus, 0, 0, 0)
+	vorbis := []byte("\x01vorbis\x00\x00\x00\x00\x02")
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, 22050)
+	vorbis = append(vorbis, make([]byte, 14)...)
+
+	var ogg []byte
+	ogg = append(ogg, oggPage(1, 0, 0, 0x02, opus)...)
+	ogg = append(ogg, oggPage(1, 1, 96312, 0x04, make([]byte, 50))...)
+	ogg = append(ogg, oggPage(2, 0, 0, 0x02, vorbis)...)
+	ogg = append(ogg, oggPage(2, 1, 22050, 0x04, make([]byte, 50))...)
+
+	var sampleDuration float64 = 3
+	info, err := ParseOgg(bytes.NewReader(ogg))
+	fmt.Println(sampleDuration, info.Duration)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if len(info.Links) != 2 || info.Links[0].Codec != "opus" || info.Links[1].Codec != "vorbis" ||
+		info.Links[1].SampleRate != 22050 || math.Abs(info.Links[0].Duration-2) > delta {
+		t.Errorf("unexpected links %+v\n", info.Links)
+	}
+	if math.Abs(info.Duration-sampleDuration) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, info.Duration)
+	}
+
+	// the second link reuses the serial number of the first one
+	var sameSerial []byte
+	sameSerial = append(sameSerial, oggPage(1, 0, 0, 0x02, opus)...)
+	sameSerial = append(sameSerial, oggPage(1, 1, 96312, 0x04, make([]byte, 50))...)
+	sameSerial = append(sameSerial, oggPage(1, 0, 0, 0x02, opus)...)
+	sameSerial = append(sameSerial, oggPage(1, 1, 48312, 0x04, make([]byte, 50))...)
+	info, err = parseOggFull(bytes.NewReader(sameSerial))
+	fmt.Println(sampleDuration, info.Duration)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if len(info.Links) != 2 || math.Abs(info.Links[0].Duration-2) > delta ||
+		math.Abs(info.Links[1].Duration-1) > delta || math.Abs(info.Duration-sampleDuration) > delta {
+		t.Errorf("unexpected links %+v\n", info.Links)
+	}
+
+	// the sample chained with itself
+	sample, err := os.ReadFile("samples/example.ogg")
+	if err != nil {
+		t.Fatalf("Sample OGG file: %s.\n", err)
+	}
+	info, err = parseOggFull(bytes.NewReader(append(append([]byte{}, sample...), sample...)))
+	fmt.Println(2*6.104036, info.Duration)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if len(info.Links) != 2 || info.Links[0].Serial != info.Links[1].Serial ||
+		math.Abs(info.Duration-2*6.104036) > delta {
+		t.Errorf("unexpected links %+v\n", info.Links)
+	}
+}
+
+func TestOggCorruptTail(t *testing.T) {
+	head := []byte("OpusHead\x01\x02")
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 44100)
+	head = append(head, 0, 0, 0)
+
+	var ogg []byte
+	ogg = append(ogg, oggPage(7, 0, 0, 0x02, head)...)
+	ogg = append(ogg, oggPage(7, 1, 96312, 0x04, make([]byte, 100))...)
+	// A truncated page at the end of file
+	ogg = append(ogg, oggPage(7, 2, 99999999, 0x04, make([]byte, 100))[:60]...)
+
+	var sampleDuration float64 = 2
+	d, err := Ogg(bytes.NewReader(ogg))
+	fmt.Println(sampleDuration, d)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if math.Abs(d-sampleDuration) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", sampleDuration, d)
+	}
+}
+
+func TestOggTail(t *testing.T) {
+	head := []byte("OpusHead\x01\x02")
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	// only the last blocks of a 2 MB file are read
+	var ogg []byte
+	ogg = append(ogg, oggPage(7, 0, 0, 0x02, head)...)
+	for i := uint32(1); i <= 40; i++ {
+		ogg = append(ogg, oggPage(7, i, uint64(i)*48000+312, 0, make([]byte, 50000))...)
+	}
+	ogg = append(ogg, make([]byte, 70000)...)
+	r := &countingReader{ReadSeeker: bytes.NewReader(ogg)}
+	d, err := Ogg(r)
+	fmt.Println(40, d, r.n)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if math.Abs(d-40) > delta || r.n > 4*oggTailChunk {
+		t.Errorf("unexpected duration %v after reading %d bytes\n", d, r.n)
+	}
+
+	// the sample is longer than one block
+	sample, err := os.ReadFile("samples/example.ogg")
+	if err != nil {
+		t.Fatalf("Sample OGG file: %s.\n", err)
+	}
+	r = &countingReader{ReadSeeker: bytes.NewReader(sample)}
+	d, err = Ogg(r)
+	fmt.Println(6.104036, d, r.n)
+	if err != nil || math.Abs(d-6.104036) > delta || r.n >= len(sample) {
+		t.Errorf("unexpected duration %v (%v) after reading %d bytes\n", d, err, r.n)
+	}
+
+	// a chain whose links share the serial number is scanned in full
+	var chain []byte
+	chain = append(chain, oggPage(7, 0, 0, 0x02, head)...)
+	chain = append(chain, oggPage(7, 1, 96312, 0x04, make([]byte, 50))...)
+	chain = append(chain, oggPage(7, 0, 0, 0x02, head)...)
+	chain = append(chain, oggPage(7, 1, 48312, 0x04, make([]byte, 50))...)
+	info, err := ParseOgg(bytes.NewReader(chain))
+	fmt.Println(3, info.Duration)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if len(info.Links) != 2 || math.Abs(info.Duration-3) > delta {
+		t.Errorf("unexpected links %+v\n", info.Links)
+	}
+}
+
+func TestVerifyOgg(t *testing.T) {
+	testFile := "samples/example.ogg"
+	data, err := os.ReadFile(testFile)
+	if err != nil {
+		t.Fatalf("Sample OGG file(%s): %s.\n", testFile, err)
+	}
+	v, err := VerifyOgg(bytes.NewReader(data))
+	fmt.Printf("%+v\n", v)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if !v.Valid() || v.Pages == 0 {
+		t.Errorf("expected valid ogg, found %+v\n", v)
+	}
+
+	var ogg []byte
+	for i := uint32(0); i < 6; i++ {
+		page := oggPage(1, i, uint64(i)*1000, 0, make([]byte, 100))
+		switch i {
+		case 2:
+			// corrupted data
+			page[50] ^= 0xFF
+		case 3:
+			// lost page
+			continue
+		case 4:
+			// junk before the page
+			ogg = append(ogg, []byte("garbage")...)
+		}
+		ogg = append(ogg, page...)
+	}
+	v, err = VerifyOgg(bytes.NewReader(ogg))
+	fmt.Printf("%+v\n", v)
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if v.Pages != 4 || len(v.BadPages) != 1 || len(v.Gaps) != 1 || len(v.Resyncs) != 1 {
+		t.Errorf("unexpected verify result %+v\n", v)
+	}
+	if v.Gaps[0].Expected != 2 || v.Gaps[0].Found != 4 {
+		t.Errorf("unexpected gap %+v\n", v.Gaps[0])
+	}
+}
+
+func TestOggComment(t *testing.T) {
+	file, err := os.Open("samples/example.ogg")
+	if err != nil {
+		t.Fatalf("Sample OGG file: %s.\n", err)
+	}
+	defer file.Close()
+	info, err := ParseOgg(file)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	fmt.Printf("%+v\n", info.Comment)
+	if info.Comment == nil || info.Comment.Vendor == "" {
+		t.Errorf("expected vorbis comment, found %+v\n", info.Comment)
+	}
+
+	pic := binary.BigEndian.AppendUint32(nil, 3)
+	pic = binary.BigEndian.AppendUint32(pic, 10)
+	pic = append(pic, "image/jpeg"...)
+	pic = binary.BigEndian.AppendUint32(pic, 0)
+	pic = append(pic, make([]byte, 16)...)
+	pic = binary.BigEndian.AppendUint32(pic, 600)
+	pic = append(pic, bytes.Repeat([]byte{0xAB}, 600)...)
+
+	comment := []byte("OpusTags")
+	comment = binary.LittleEndian.AppendUint32(comment, 4)
+	comment = append(comment, "test"...)
+	fields := []string{
+		"title=Hello",
+		"ARTIST=A",
+		"artist=B",
+		"METADATA_BLOCK_PICTURE=" + base64.StdEncoding.EncodeToString(pic),
+	}
+	comment = binary.LittleEndian.AppendUint32(comment, uint32(len(fields)))
+	for _, f := range fields {
+		comment = binary.LittleEndian.AppendUint32(comment, uint32(len(f)))
+		comment = append(comment, f...)
+	}
+
+	head := []byte("OpusHead\x01\x02")
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 48000)
+	head = append(head, 0, 0, 0)
+
+	var ogg []byte
+	ogg = append(ogg, oggPage(7, 0, 0, 0x02, head)...)
+	ogg = append(ogg, oggOpenPage(7, 1, 0, comment[:510])...)
+	ogg = append(ogg, oggPage(7, 2, 0, 0x01, comment[510:])...)
+	ogg = append(ogg, oggPage(7, 3, 48312, 0x04, make([]byte, 100))...)
+
+	info, err = ParseOgg(bytes.NewReader(ogg))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	c := info.Comment
+	if c == nil || c.Vendor != "test" || c.Comments["TITLE"][0] != "Hello" || len(c.Comments["ARTIST"]) != 2 {
+		t.Fatalf("unexpected opus comment %+v\n", c)
+	}
+	if len(c.Pictures) != 1 || c.Pictures[0].MIME != "image/jpeg" || len(c.Pictures[0].Data) != 600 {
+		t.Errorf("unexpected pictures %+v\n", c.Pictures)
+	}
+}
+
+func TestWav(t *testing.T) {
+	pcm := wavFile(
+		riffChunk("fmt ", wavFmt(1, 2, 44100, 176400, 4, 16, nil)),
+		riffChunk("data", make([]byte, 176400*2)),
+	)
+	imaExt := binary.LittleEndian.AppendUint16(nil, 505)
+	imaFmt := riffChunk("fmt ", wavFmt(0x11, 1, 8000, 4055, 256, 4, imaExt))
+	ima := wavFile(
+		imaFmt,
+		riffChunk("fact", binary.LittleEndian.AppendUint32(nil, 5000)),
+		riffChunk("data", make([]byte, 2560)),
+	)
+	imaNoFact := wavFile(
+		imaFmt,
+		riffChunk("data", make([]byte, 2560)),
+	)
+	testSet := map[string]struct {
+		data     []byte
+		duration float64
+	}{
+		"PCM":               {pcm, 2},
+		"IMA ADPCM":         {ima, 0.625},
+		"IMA ADPCM no fact": {imaNoFact, 0.63125},
+	}
+	for k, v := range testSet {
+		d, err := Wav(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, d)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if math.Abs(d-v.duration) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", v.duration, d, k)
+		}
+	}
+}
+
+func TestWav64(t *testing.T) {
+	data := make([]byte, 88200)
+	fmtChunk := wavFmt(1, 1, 44100, 88200, 2, 16, nil)
+
+	ds64 := binary.LittleEndian.AppendUint64(nil, 0)
+	ds64 = binary.LittleEndian.AppendUint64(ds64, uint64(len(data)))
+	ds64 = binary.LittleEndian.AppendUint64(ds64, 44100)
+	ds64 = binary.LittleEndian.AppendUint32(ds64, 0)
+	rf64 := []byte("RF64\xff\xff\xff\xffWAVE")
+	rf64 = append(rf64, riffChunk("ds64", ds64)...)
+	rf64 = append(rf64, riffChunk("fmt ", fmtChunk)...)
+	rf64 = append(rf64, "data\xff\xff\xff\xff"...)
+	rf64 = append(rf64, data...)
+
+	suffix := "\xf3\xac\xd3\x11\x8c\xd1\x00\xc0\x4f\x8e\xdb\x8a"
+	body := []byte("wave" + suffix)
+	body = append(body, w64Chunk("junk"+suffix, make([]byte, 5))...)
+	body = append(body, w64Chunk("fmt "+suffix, fmtChunk)...)
+	body = append(body, w64Chunk("data"+suffix, data)...)
+	w64 := w64Chunk("riff\x2e\x91\xcf\x11\xa5\xd6\x28\xdb\x04\xc1\x00\x00", body)
+
+	for k, v := range map[string][]byte{"RF64": rf64, "W64": w64} {
+		info, err := ParseWav(bytes.NewReader(v))
+		fmt.Println(k, 1, info.Duration)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if info.Container != k || math.Abs(info.Duration-1) > delta {
+			t.Errorf("unexpected result on item '%v': %+v\n", k, info)
+		}
+	}
+
+	// corrupt chunk sizes must fail without huge allocations or seeks
+	w64Sized := func(id string, size uint64) []byte {
+		b := []byte("wave" + suffix + id + suffix)
+		b = binary.LittleEndian.AppendUint64(b, size)
+		b = append(b, fmtChunk...)
+		return w64Chunk("riff\x2e\x91\xcf\x11\xa5\xd6\x28\xdb\x04\xc1\x00\x00", b)
+	}
+	riffFmt := []byte("RIFF\x00\x00\x00\x00WAVEfmt \xf0\xff\xff\xff")
+	for k, v := range map[string][]byte{
+		"W64 fmt":  w64Sized("fmt ", 1<<62),
+		"W64 junk": w64Sized("junk", 1<<63+24),
+		"RIFF fmt": append(riffFmt, fmtChunk...),
+	} {
+		if _, err := ParseWav(bytes.NewReader(v)); err == nil {
+			t.Errorf("expected error on item '%v'\n", k)
+		}
+	}
+}
+
+func TestWavExtensible(t *testing.T) {
+	ext := binary.LittleEndian.AppendUint16(nil, 24)
+	ext = binary.LittleEndian.AppendUint32(ext, 0x3F)
+	ext = append(ext, "\x03\x00\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"...)
+	data := wavFile(
+		riffChunk("fmt ", wavFmt(0xFFFE, 6, 48000, 48000*24, 24, 32, ext)),
+		riffChunk("data", make([]byte, 48000*24/2)),
+	)
+	info, err := ParseWav(bytes.NewReader(data))
+	fmt.Printf("%+v\n", info)
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if info.FormatCode() != 3 || info.FormatName != "IEEE float" || info.ValidBitsPerSample != 24 ||
+		info.SubFormat != "00000003-0000-0010-8000-00aa00389b71" || info.Channels != 6 {
+		t.Errorf("unexpected fmt %+v\n", info)
+	}
+	if fmt.Sprint(info.ChannelLayout()) != "[FL FR FC LFE BL BR]" {
+		t.Errorf("unexpected channel layout %v\n", info.ChannelLayout())
+	}
+	if math.Abs(info.Duration-0.5) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", 0.5, info.Duration)
+	}
+}
+
+func TestWavTruncated(t *testing.T) {
+	fmtChunk := riffChunk("fmt ", wavFmt(1, 2, 8000, 32000, 4, 16, nil))
+	build := func(size uint32, n int) []byte {
+		b := []byte("RIFF\x00\x00\x00\x00WAVE")
+		b = append(b, fmtChunk...)
+		b = append(b, "data"...)
+		b = binary.LittleEndian.AppendUint32(b, size)
+		return append(b, make([]byte, n)...)
+	}
+	testSet := map[string][]byte{
+		"zero size":      build(0, 16002),
+		"unknown size":   build(0xFFFFFFFF, 16001),
+		"truncated file": build(64000, 16003),
+	}
+	for k, v := range testSet {
+		info, err := ParseWav(bytes.NewReader(v))
+		fmt.Println(k, 0.5, info.Duration)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if !info.HeaderInconsistent || info.DataSize != 16000 || math.Abs(info.Duration-0.5) > delta {
+			t.Errorf("unexpected result on item '%v': %+v\n", k, info)
+		}
+	}
+
+	// an empty data chunk followed by metadata is not a streaming header
+	infoList := append([]byte("INFO"), riffChunk("INAM", []byte("Title\x00"))...)
+	empty := wavFile(fmtChunk, riffChunk("data", nil), riffChunk("LIST", infoList))
+	info, err := ParseWav(bytes.NewReader(empty))
+	if err != nil {
+		t.Errorf("%s\n", err)
+	}
+	if info.HeaderInconsistent || info.DataSize != 0 || info.Duration != 0 || info.Info["INAM"] != "Title" {
+		t.Errorf("unexpected result on empty data: %+v\n", info)
+	}
+}
+
+func TestWavMetadata(t *testing.T) {
+	bext := make([]byte, 602)
+	copy(bext[0:], "A description")
+	copy(bext[256:], "Recorder")
+	binary.LittleEndian.PutUint32(bext[338:342], 48000*3600)
+	binary.LittleEndian.PutUint16(bext[346:348], 2)
+	binary.LittleEndian.PutUint16(bext[412:414], uint16(0x10000-2300)) // -23.00 LUFS
+	bext = append(bext, "A=PCM\r\n"...)
+
+	cue := binary.LittleEndian.AppendUint32(nil, 2)
+	for i, pos := range []uint32{24000, 72000} {
+		point := make([]byte, 24)
+		binary.LittleEndian.PutUint32(point[0:4], uint32(i+1))
+		copy(point[8:12], "data")
+		binary.LittleEndian.PutUint32(point[20:24], pos)
+		cue = append(cue, point...)
+	}
+	adtl := []byte("adtl")
+	adtl = append(adtl, riffChunk("labl", []byte("\x01\x00\x00\x00Intro\x00"))...)
+	adtl = append(adtl, riffChunk("ltxt", []byte("\x02\x00\x00\x00\x80\xbb\x00\x00rgn \x00\x00\x00\x00\x00\x00\x00\x00"))...)
+	infoList := []byte("INFO")
+	infoList = append(infoList, riffChunk("INAM", []byte("Title\x00"))...)
+	infoList = append(infoList, riffChunk("IART", []byte("Artist\x00"))...)
+
+	smpl := make([]byte, 36+24)
+	binary.LittleEndian.PutUint32(smpl[12:16], 60)
+	binary.LittleEndian.PutUint32(smpl[28:32], 1)
+	binary.LittleEndian.PutUint32(smpl[36+8:36+12], 100)
+	binary.LittleEndian.PutUint32(smpl[36+12:36+16], 2000)
+
+	data := wavFile(
+		riffChunk("bext", bext),
+		riffChunk("fmt ", wavFmt(1, 1, 48000, 96000, 2, 16, nil)),
+		riffChunk("cue ", cue),
+		riffChunk("data", make([]byte, 96000*2)),
+		riffChunk("LIST", adtl),
+		riffChunk("LIST", infoList),
+		riffChunk("smpl", smpl),
+		riffChunk("iXML", []byte("<BWFXML/>")),
+	)
+	info, err := ParseWav(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s\n", err)
+	}
+	if math.Abs(info.Duration-2) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", 2, info.Duration)
+	}
+	if info.Bext == nil || info.Bext.Originator != "Recorder" || info.Bext.TimeReference != 48000*3600 ||
+		info.Bext.LoudnessValue != -23 || info.Bext.CodingHistory != "A=PCM\r\n" {
+		t.Errorf("unexpected bext %+v\n", info.Bext)
+	}
+	if len(info.Cues) != 2 || info.Cues[0].Label != "Intro" || info.Cues[1].Length != 48000 ||
+		math.Abs(info.Cues[1].Time-1.5) > delta {
+		t.Errorf("unexpected cues %+v\n", info.Cues)
+	}
+	if info.Info["INAM"] != "Title" || info.Info["IART"] != "Artist" {
+		t.Errorf("unexpected info %+v\n", info.Info)
+	}
+	if info.Sampler == nil || info.Sampler.MIDIUnityNote != 60 || len(info.Sampler.Loops) != 1 ||
+		info.Sampler.Loops[0].End != 2000 {
+		t.Errorf("unexpected smpl %+v\n", info.Sampler)
+	}
+	if info.IXML != "<BWFXML/>" {
+		t.Errorf("unexpected iXML %q\n", info.IXML)
+	}
+
+	// malformed and truncated metadata chunks do not hide the duration
+	bad := wavFile(
+		riffChunk("fmt ", wavFmt(1, 1, 48000, 96000, 2, 16, nil)),
+		riffChunk("bext", make([]byte, 100)),
+		riffChunk("data", make([]byte, 96000*2)),
+		riffChunk("cue ", []byte{1, 0}),
+		riffChunk("smpl", make([]byte, 10)),
+	)
+	bad = append(bad, "LIST\x64\x00\x00\x00INFO"...)
+	d, err := Wav(bytes.NewReader(bad))
+	if err != nil || math.Abs(d-2) > delta {
+		t.Errorf("unexpected duration %v (%v)\n", d, err)
+	}
+	info, err = ParseWav(bytes.NewReader(bad))
+	if err != nil || math.Abs(info.Duration-2) > delta {
+		t.Errorf("unexpected duration %v (%v)\n", info.Duration, err)
+	}
+	if info.Bext != nil || info.Cues != nil || info.Sampler != nil || info.Info != nil {
+		t.Errorf("unexpected metadata %+v\n", info)
+	}
+}
+
+func TestAiff(t *testing.T) {
+	comm := binary.BigEndian.AppendUint16(nil, 2)
+	comm = binary.BigEndian.AppendUint32(comm, 88200)
+	comm = binary.BigEndian.AppendUint16(comm, 16)
+	comm = append(comm, extended(44100)...)
+	ssnd := make([]byte, 8+88200*4)
+	body := []byte("AIFF")
+	body = append(body, aiffChunk("COMM", comm)...)
+	body = append(body, aiffChunk("SSND", ssnd)...)
+	aiff := aiffChunk("FORM", body)
+
+	commC := binary.BigEndian.AppendUint16(nil, 1)
+	commC = binary.BigEndian.AppendUint32(commC, 250)
+	commC = binary.BigEndian.AppendUint16(commC, 16)
+	commC = append(commC, extended(8000)...)
+	commC = append(commC, "ima4\x0dIMA 4:1 ADPCM"...)
+	bodyC := []byte("AIFC")
+	bodyC = append(bodyC, aiffChunk("FVER", []byte("\xa2\x80\x51\x40"))...)
+	bodyC = append(bodyC, aiffChunk("COMM", commC)...)
+	bodyC = append(bodyC, aiffChunk("SSND", make([]byte, 8+250*34))...)
+	aifc := aiffChunk("FORM", bodyC)
+
+	testSet := map[string]struct {
+		data     []byte
+		duration float64
+	}{
+		"AIFF":        {aiff, 2},
+		"AIFF-C ima4": {aifc, 2},
+	}
+	for k, v := range testSet {
+		info, err := ParseAiff(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, info.Duration)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if math.Abs(info.Duration-v.duration) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", v.duration, info.Duration, k)
+		}
+	}
+
+	// a corrupt COMM size must not be allocated
+	hugeComm := []byte("FORM\x00\x00\x00\x00AIFFCOMM\xff\xff\xff\xf0")
+	if _, err := ParseAiff(bytes.NewReader(append(hugeComm, comm...))); err == nil {
+		t.Errorf("expected error on COMM size\n")
+	}
+	// an SSND offset past the chunk leaves no sound data
+	bodyO := []byte("AIFF")
+	bodyO = append(bodyO, aiffChunk("COMM", comm)...)
+	bodyO = append(bodyO, aiffChunk("SSND", []byte("\xff\xff\xff\xfc\x00\x00\x00\x00\x00\x00\x00\x00"))...)
+	info, err := ParseAiff(bytes.NewReader(aiffChunk("FORM", bodyO)))
+	if err == nil && info.SoundDataSize != 0 {
+		t.Errorf("unexpected sound data size %d\n", info.SoundDataSize)
+	}
+}
+
+func TestCaf(t *testing.T) {
+	lpcm := []byte("caff\x00\x01\x00\x00")
+	lpcm = append(lpcm, cafChunk("desc", 32, cafDesc(48000, "lpcm", 4, 1, 2, 16))...)
+	lpcm = append(lpcm, cafChunk("data", -1, make([]byte, 4+48000*4))...)
+
+	pakt := binary.BigEndian.AppendUint64(nil, 100)
+	pakt = binary.BigEndian.AppendUint64(pakt, 100*1024-2112-288)
+	pakt = binary.BigEndian.AppendUint32(pakt, 2112)
+	pakt = binary.BigEndian.AppendUint32(pakt, 288)
+	pakt = append(pakt, make([]byte, 100)...)
+	aac := []byte("caff\x00\x01\x00\x00")
+	aac = append(aac, cafChunk("desc", 32, cafDesc(44100, "aac ", 0, 1024, 2, 0))...)
+	aac = append(aac, cafChunk("pakt", int64(len(pakt)), pakt)...)
+	aac = append(aac, cafChunk("data", 1004, make([]byte, 1004))...)
+
+	testSet := map[string]struct {
+		data     []byte
+		duration float64
+	}{
+		"LPCM": {lpcm, 1},
+		"AAC":  {aac, float64(100*1024-2112-288) / 44100},
+	}
+	for k, v := range testSet {
+		d, err := Caf(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, d)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if math.Abs(d-v.duration) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", v.duration, d, k)
+		}
+	}
+
+	// corrupt chunk sizes
+	hugeDesc := []byte("caff\x00\x01\x00\x00")
+	hugeDesc = append(hugeDesc, cafChunk("desc", 1<<62, cafDesc(48000, "lpcm", 4, 1, 2, 16))...)
+	negData := []byte("caff\x00\x01\x00\x00")
+	negData = append(negData, cafChunk("desc", 32, cafDesc(48000, "lpcm", 4, 1, 2, 16))...)
+	negData = append(negData, cafChunk("data", -2, make([]byte, 8))...)
+	rate := func(r float64) []byte {
+		b := []byte("caff\x00\x01\x00\x00")
+		b = append(b, cafChunk("desc", 32, cafDesc(r, "lpcm", 4, 1, 2, 16))...)
+		return append(b, cafChunk("data", 12, make([]byte, 12))...)
+	}
+	for k, v := range map[string][]byte{
+		"desc": hugeDesc, "data": negData,
+		"NaN rate": rate(math.NaN()), "Inf rate": rate(math.Inf(1)), "negative rate": rate(-48000),
+	} {
+		if _, err := ParseCaf(bytes.NewReader(v)); err == nil {
+			t.Errorf("expected error on item '%v'\n", k)
+		}
+	}
+}
+
+func TestAuVocRaw(t *testing.T) {
+	au := []byte(".snd")
+	for _, v := range []uint32{24, 0xFFFFFFFF, 3, 8000, 2} {
+		au = binary.BigEndian.AppendUint32(au, v)
+	}
+	au = append(au, make([]byte, 8000*4)...)
+
+	voc := []byte(vocMagic + "\x1a\x00\x14\x01\x1f\x11")
+	// 8-bit mono at 1000000/(256-156) = 10000 Hz, 5000 samples
+	voc = append(voc, 1, 0x8a, 0x13, 0x00, 156, 0)
+	voc = append(voc, make([]byte, 5000)...)
+	// 2500 samples of silence
+	voc = append(voc, 3, 3, 0, 0, 0xc3, 0x09, 156)
+	// 16-bit stereo at 8000 Hz, 2000 frames
+	voc = append(voc, 9, 0x4c, 0x1f, 0x00)
+	voc = binary.LittleEndian.AppendUint32(voc, 8000)
+	voc = append(voc, 16, 2, 4, 0, 0, 0, 0, 0)
+	voc = append(voc, make([]byte, 8000)...)
+	voc = append(voc, 0)
+
+	testSet := map[string]struct {
+		fn       func(io.ReadSeeker) (float64, error)
+		data     []byte
+		duration float64
+	}{
+		"AU":  {Au, au, 1},
+		"VOC": {Voc, voc, 1},
+		"Raw": {func(r io.ReadSeeker) (float64, error) { return RawPCM(r, 16000, 1, 16) }, make([]byte, 48000), 1.5},
+	}
+	for k, v := range testSet {
+		d, err := v.fn(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, d)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if math.Abs(d-v.duration) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", v.duration, d, k)
+		}
+	}
+
+	auHeader := func(offset, channels uint32) []byte {
+		b := []byte(".snd")
+		for _, v := range []uint32{offset, 32000, 3, 8000, channels} {
+			b = binary.BigEndian.AppendUint32(b, v)
+		}
+		return append(b, make([]byte, 32000)...)
+	}
+	if _, err := Au(bytes.NewReader(auHeader(8, 2))); err == nil {
+		t.Errorf("expected error on au data offset\n")
+	}
+	// 16 bits * 2^28 channels overflows 32 bits
+	d, err := Au(bytes.NewReader(auHeader(24, 1<<28)))
+	if expected := 32000.0 * 8 / (16 << 28) / 8000; err != nil || d != expected {
+		t.Errorf("expected '%v', found '%v' (%v)\n", expected, d, err)
+	}
+}
+
+func TestDff(t *testing.T) {
+	prop := func(cmpr string, rate uint32) []byte {
+		p := []byte("SND ")
+		p = append(p, dffChunk("FS  ", binary.BigEndian.AppendUint32(nil, rate))...)
+		p = append(p, dffChunk("CHNL", []byte("\x00\x02SLFTSRGT"))...)
+		return append(p, dffChunk("CMPR", []byte(cmpr+"\x0enot compressed\x00"))...)
+	}
+	build := func(prop, sound []byte) []byte {
+		form := []byte("DSD ")
+		form = append(form, dffChunk("FVER", []byte("\x01\x05\x00\x00"))...)
+		form = append(form, dffChunk("PROP", prop)...)
+		form = append(form, sound...)
+		return dffChunk("FRM8", form)
+	}
+	dsdSound := dffChunk("DSD ", make([]byte, 70560))
+	dstSound := dffChunk("DST ", append(dffChunk("FRTE", []byte("\x00\x00\x00\x96\x00\x4b")),
+		dffChunk("DSTF", make([]byte, 101))...))
+
+	testSet := map[string]struct {
+		data        []byte
+		compression string
+		duration    float64
+	}{
+		"DSD": {build(prop("DSD ", 2822400), dsdSound), "DSD", 0.1},
+		"DST": {build(prop("DST ", 2822400), dstSound), "DST", 2},
+	}
+	for k, v := range testSet {
+		info, err := ParseDSD(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, info.Duration)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if info.Compression != v.compression || math.Abs(info.Duration-v.duration) > delta {
+			t.Errorf("unexpected result on item '%v': %+v\n", k, info)
+		}
+	}
+
+	for k, v := range map[string][]byte{
+		"DSD in DST":  build(prop("DST ", 2822400), dsdSound),
+		"DST in DSD":  build(prop("DSD ", 2822400), dstSound),
+		"DST no rate": build(prop("DST ", 0), dstSound),
+	} {
+		if _, err := DSD(bytes.NewReader(v)); err == nil {
+			t.Errorf("expected error on item '%v'\n", k)
+		}
+	}
+}
+
+func TestParseDSD(t *testing.T) {
+	data, err := os.ReadFile("samples/sample.dsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ParseDSD(bytes.NewReader(data))
+	fmt.Printf("%+v\n", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Container != "DSF" || info.RateName != "DSD64" || info.Channels != 2 ||
+		info.BitsPerSample != 1 || info.BlockSizePerChannel != 4096 {
+		t.Errorf("unexpected dsf properties %+v\n", info)
+	}
+	if math.Abs(info.Duration-1.4685) > delta {
+		t.Errorf("too much error, expected '%v', found '%v'\n", 1.4685, info.Duration)
+	}
+	if info.Tags["TIT2"] != "Test Title" || info.Tags["TRCK"] != "03/06" {
+		t.Errorf("unexpected dsf tags %v\n", info.Tags)
+	}
+
+	// the duration doesn't read the tag, an oversized tag is ignored
+	tagOffset := int64(binary.LittleEndian.Uint64(data[20:28]))
+	d, err := DSD(&failingReader{ReadSeeker: bytes.NewReader(data), from: tagOffset})
+	if err != nil || math.Abs(d-1.4685) > delta {
+		t.Errorf("unexpected duration %v (%v)\n", d, err)
+	}
+	huge := append([]byte(nil), data...)
+	copy(huge[tagOffset+6:tagOffset+10], []byte{0x7f, 0x7f, 0x7f, 0x7f})
+	if info, err := ParseDSD(bytes.NewReader(huge)); err != nil || info.Tags != nil {
+		t.Errorf("unexpected result on oversized tag: %v %+v\n", err, info)
+	}
+
+	// MSB first bit order
+	msb := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(msb[60:64], 8)
+	if info, err := ParseDSD(bytes.NewReader(msb)); err != nil || math.Abs(info.Duration-1.4685) > delta {
+		t.Errorf("unexpected result on MSB first file: %v %+v\n", err, info)
+	}
+
+	// unknown format id
+	bad := append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(bad[44:48], 1)
+	if _, err := ParseDSD(bytes.NewReader(bad)); err == nil {
+		t.Errorf("expected error on format id\n")
+	}
+	// data chunk shorter than the sample count
+	bad = append([]byte(nil), data...)
+	binary.LittleEndian.PutUint64(bad[84:92], 12+2*4096*100)
+	if _, err := ParseDSD(bytes.NewReader(bad)); err == nil {
+		t.Errorf("expected error on data chunk size\n")
+	}
+}
+
+func TestMp4Fragmented(t *testing.T) {
+	// version/flags, creation, modification, timescale, duration
+	mvhd := mp4Box("mvhd", u32s(0, 0, 0, 1000, 0), make([]byte, 80))
+	trak := mp4Box("trak",
+		mp4Box("tkhd", u32s(7, 0, 0, 1, 0, 0), make([]byte, 60)),
+		mp4Box("mdia",
+			mp4Box("mdhd", u32s(0, 0, 0, 48000, 0, 0)),
+			mp4Box("hdlr", u32s(0, 0), []byte("soun"), make([]byte, 13))))
+	trex := mp4Box("trex", u32s(0, 1, 1, 1024, 0, 0))
+	moof := func(trafs ...[]byte) []byte {
+		return mp4Box("moof", mp4Box("mfhd", u32s(0, 1)), mp4Box("traf", trafs...))
+	}
+	ftyp := mp4Box("ftyp", []byte("iso6"), u32s(0), []byte("iso6dash"))
+	build := func(mvex []byte, moofs ...[]byte) []byte {
+		file := append(append([]byte(nil), ftyp...), mp4Box("moov", mvhd, trak, mvex)...)
+		for _, m := range moofs {
+			file = append(file, m...)
+			file = append(file, mp4Box("mdat", make([]byte, 32))...)
+		}
+		return file
+	}
+	// 47 samples of the trex default duration, with a 5-byte sdtp
+	frag1 := moof(mp4Box("tfhd", u32s(0, 1)), mp4Box("tfdt", u32s(1<<24, 0, 0)),
+		mp4Box("trun", u32s(0, 47)), mp4Box("sdtp", []byte{0, 0, 0, 0, 0x20}))
+	// 3 samples with explicit durations and sizes after a data offset
+	frag2 := moof(mp4Box("tfhd", u32s(0, 1)),
+		mp4Box("trun", u32s(0x301, 3, 100, 1024, 10, 1024, 10, 512, 10)))
+	// segment starting at 10 s with a tfhd default duration of 960
+	segment := moof(mp4Box("tfhd", u32s(0x08, 1, 960)), mp4Box("tfdt", u32s(0, 480000)),
+		mp4Box("trun", u32s(0, 50)))
+
+	testSet := map[string]struct {
+		data     []byte
+		duration float64
+	}{
+		"mehd":    {build(mp4Box("mvex", mp4Box("mehd", u32s(0, 2500)), trex), frag1), 2.5},
+		"trun":    {build(mp4Box("mvex", trex), frag1, frag2), 50688.0 / 48000},
+		"segment": {build(mp4Box("mvex", trex), segment), 1},
+	}
+	for k, v := range testSet {
+		d, err := Mp4(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, d)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+		}
+		if math.Abs(d-v.duration) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", v.duration, d, k)
+		}
+	}
+}
+
+func TestMp4Tracks(t *testing.T) {
+	mvhd := mp4Box("mvhd", u32s(0, 0, 0, 1000, 5000), make([]byte, 80))
+	data := mp4Box("moov", mvhd,
+		mp4Trak(1, 3, "vide", "und", 90000, 450000),
+		mp4Trak(2, 2, "soun", "eng", 48000, 240000),
+		mp4Trak(3, 3, "soun", "fra", 48000, 144000),
+		mp4Trak(4, 3, "soun", "eng", 44100, 176400))
+	info, err := ParseMp4(bytes.NewReader(data))
+	fmt.Printf("%+v\n", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Tracks) != 4 || info.Tracks[0].Handler != "vide" || info.Tracks[1].Enabled {
+		t.Errorf("unexpected tracks %+v\n", info.Tracks)
+	}
+	if math.Abs(info.Duration-3) > delta {
+		t.Errorf("expected the first enabled audio track, found '%v'\n", info.Duration)
+	}
+	if tr, ok := info.LongestAudioTrack(); !ok || tr.ID != 2 {
+		t.Errorf("unexpected longest audio track %+v\n", tr)
+	}
+	if tr, ok := info.AudioTrackByLanguage("eng"); !ok || tr.ID != 4 || math.Abs(tr.Duration-4) > delta {
+		t.Errorf("unexpected eng audio track %+v\n", tr)
+	}
+	if _, ok := info.AudioTrackByLanguage("deu"); ok {
+		t.Errorf("unexpected deu audio track\n")
+	}
+
+	file, err := os.Open("samples/sample.m4a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err = ParseMp4(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Tracks) != 1 || info.Tracks[0].Language != "und" || !info.Tracks[0].Enabled {
+		t.Errorf("unexpected tracks %+v\n", info.Tracks)
+	}
+}
+
+func TestMp4Gapless(t *testing.T) {
+	mvhd := mp4Box("mvhd", u32s(0, 0, 0, 44100, 0), make([]byte, 80))
+	// the mdhd duration is off, the stts holds 147 frames of 1024 samples
+	trak := func(edts []byte) []byte {
+		return mp4Box("trak",
+			mp4Box("tkhd", u32s(3, 0, 0, 1, 0, 0), make([]byte, 60)),
+			edts,
+			mp4Box("mdia",
+				mp4Box("mdhd", u32s(0, 0, 0, 44100, 152000, 0)),
+				mp4Box("hdlr", u32s(0, 0), []byte("soun"), make([]byte, 13)),
+				mp4Box("minf", mp4Box("stbl", mp4Box("stts", u32s(0, 1, 147, 1024))))))
+	}
+	elst := func(entries ...uint32) []byte {
+		return mp4Box("edts", mp4Box("elst", u32s(0, uint32(len(entries)/3)), u32s(entries...)))
+	}
+	smpb := mp4Box("udta", mp4Box("meta", u32s(0),
+		mp4Box("hdlr", u32s(0, 0), []byte("mdir"), make([]byte, 13)),
+		mp4Box("ilst", mp4Box("----",
+			mp4Box("mean", u32s(0), []byte("com.apple.iTunes")),
+			mp4Box("name", u32s(0), []byte("iTunSMPB")),
+			mp4Box("data", u32s(1, 0), []byte(" 00000000 00000840 000001A0 0000000000024220"))))))
+
+	testSet := map[string]struct {
+		data     []byte
+		duration float64
+		priming  uint64
+		padding  uint64
+	}{
+		"stts":       {mp4Box("moov", mvhd, trak(nil)), 150528.0 / 44100, 0, 0},
+		"elst":       {mp4Box("moov", mvhd, trak(elst(148000, 2112, 1<<16))), 148000.0 / 44100, 2112, 416},
+		"empty edit": {mp4Box("moov", mvhd, trak(elst(44100, 0xFFFFFFFF, 1<<16, 0, 2112, 1<<16))), 1 + 148416.0/44100, 2112, 0},
+		"iTunSMPB":   {mp4Box("moov", mvhd, trak(nil), smpb), 148000.0 / 44100, 2112, 416},
+	}
+	for k, v := range testSet {
+		info, err := ParseMp4(bytes.NewReader(v.data))
+		fmt.Println(k, v.duration, info.Duration)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+			continue
+		}
+		if math.Abs(info.Duration-v.duration) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", v.duration, info.Duration, k)
+		}
+		if tr := info.Tracks[0]; tr.Priming != v.priming || tr.Padding != v.padding {
+			t.Errorf("unexpected priming/padding %d/%d on item '%v'\n", tr.Priming, tr.Padding, k)
+		}
+	}
+}
+
+func TestMp4Codec(t *testing.T) {
+	entry := func(typ string, channels, bits uint16, sampleRate uint32, children ...[]byte) []byte {
+		fields := u32s(0, 1, 0, 0, uint32(channels)<<16|uint32(bits), 0, sampleRate<<16)
+		return mp4Box(typ, append([][]byte{fields}, children...)...)
+	}
+	esds := func(oti byte, asc string) []byte {
+		dsi, _ := hex.DecodeString(asc)
+		dcd := append([]byte{oti, 0x15, 0, 0, 0}, u32s(0, 0)...)
+		dcd = append(dcd, 0x05, byte(len(dsi)))
+		dcd = append(dcd, dsi...)
+		es := append([]byte{0, 1, 0, 0x04, byte(len(dcd))}, dcd...)
+		es = append(es, 0x06, 0x01, 0x02)
+		return mp4Box("esds", u32s(0), append([]byte{0x03, 0x80, 0x80, 0x80, byte(len(es))}, es...))
+	}
+	streamInfo, _ := hex.DecodeString("1000100000000e00001a0ac442f000000000")
+	testSet := map[string]struct {
+		entry      []byte
+		codec      string
+		sampleRate uint32
+		channels   uint16
+	}{
+		"AAC-LC":   {entry("mp4a", 2, 16, 44100, esds(0x40, "1210")), "AAC-LC", 44100, 2},
+		"HE-AAC":   {entry("mp4a", 2, 16, 24000, esds(0x40, "2b1188")), "HE-AAC", 48000, 2},
+		"HE-AACv2": {entry("mp4a", 1, 16, 24000, esds(0x40, "130856e59d4880")), "HE-AACv2", 48000, 2},
+		"MP3":      {entry("mp4a", 2, 16, 44100, esds(0x6B, "")), "MP3", 44100, 2},
+		"ALAC":     {entry("alac", 2, 16, 44100, mp4Box("alac", u32s(0, 4096, 0x00180000|0x28<<8|0x0A, 0x0600ff, 0, 0, 96000))), "ALAC", 96000, 6},
+		"Opus":     {entry("Opus", 2, 16, 48000, mp4Box("dOps", []byte{0, 6, 1, 0x38, 0, 0, 0xbb, 0x80, 0, 0, 1}, make([]byte, 8))), "Opus", 48000, 6},
+		"FLAC":     {entry("fLaC", 2, 16, 44100, mp4Box("dfLa", u32s(0, 0x80000022), streamInfo)), "FLAC", 44100, 2},
+		"AC-3":     {entry("ac-3", 2, 16, 48000, mp4Box("dac3", []byte{0x50, 0x3d, 0xe0})), "AC-3", 44100, 6},
+		"E-AC-3":   {entry("ec-3", 2, 16, 48000, mp4Box("dec3", []byte{0x03, 0x00, 0x20, 0x04, 0x00})), "E-AC-3", 48000, 2},
+		// malformed sample descriptions leave the codec unset
+		"no entry":  {nil, "", 0, 0},
+		"bad entry": {u32s(200, 0), "", 0, 0},
+	}
+	for k, v := range testSet {
+		data := mp4Box("moov", mp4Box("mvhd", u32s(0, 0, 0, 1000, 1000), make([]byte, 80)),
+			mp4Box("trak",
+				mp4Box("tkhd", u32s(3, 0, 0, 1, 0, 0), make([]byte, 60)),
+				mp4Box("mdia",
+					mp4Box("mdhd", u32s(0, 0, 0, v.sampleRate, v.sampleRate, 0)),
+					mp4Box("hdlr", u32s(0, 0), []byte("soun"), make([]byte, 13)),
+					mp4Box("minf", mp4Box("stbl", mp4Box("stsd", u32s(0, 1), v.entry))))))
+		info, err := ParseMp4(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+			continue
+		}
+		tr := info.Tracks[0]
+		fmt.Println(k, tr.Codec, tr.SampleRate, tr.Channels)
+		if tr.Codec != v.codec || tr.SampleRate != v.sampleRate || tr.Channels != v.channels {
+			t.Errorf("expected %s %d Hz %d channels, found %s %d Hz %d channels\n",
+				v.codec, v.sampleRate, v.channels, tr.Codec, tr.SampleRate, tr.Channels)
+		}
+	}
+}
+
+func TestMp4Metadata(t *testing.T) {
+	file, err := os.Open("samples/sample.m4a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	info, err := ParseMp4(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := info.Metadata
+	if m == nil {
+		t.Fatal("missing metadata")
+	}
+	fmt.Printf("%+v\n", *m)
+	if m.Title != "Test Title" || m.Artist != "Test Artist" || m.Album != "Test Album" ||
+		m.TrackNumber != 3 || m.TrackTotal != 6 || m.DiscNumber != 2 ||
+		m.Freeform["author"][0] != "Test Author" {
+		t.Errorf("unexpected metadata %+v\n", *m)
+	}
+
+	data := func(typ uint32, value []byte) []byte {
+		return mp4Box("data", u32s(typ, 0), value)
+	}
+	png := []byte("\x89PNG\r\n\x1a\n")
+	moov := mp4Box("moov", mp4Box("mvhd", u32s(0, 0, 0, 1000, 1000), make([]byte, 80)),
+		mp4Trak(1, 3, "soun", "und", 44100, 44100),
+		mp4Box("udta",
+			mp4Box("\xa9nam", []byte{0, 8, 0x15, 0xc7}, []byte("QT title")),
+			mp4Box("\xa9too", []byte{0, 6, 0x15, 0xc7}, []byte("Lavf58")),
+			mp4Box("meta", u32s(0),
+				mp4Box("hdlr", u32s(0, 0), []byte("mdir"), make([]byte, 13)),
+				mp4Box("ilst",
+					mp4Box("\xa9nam", data(1, []byte("Title"))),
+					mp4Box("gnre", data(0, []byte{0, 10})),
+					mp4Box("tmpo", data(21, []byte{0, 120})),
+					mp4Box("covr", data(14, png), data(13, []byte{0xff, 0xd8})),
+					mp4Box("----",
+						mp4Box("mean", u32s(0), []byte("com.apple.iTunes")),
+						mp4Box("name", u32s(0), []byte("iTunNORM")),
+						data(1, []byte(" 00000A2B")))))))
+	info, err = ParseMp4(bytes.NewReader(moov))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = info.Metadata
+	if m.Title != "Title" || m.Genre != "Metal" || m.Items["tmpo"][0] != "120" ||
+		m.Items["©too"][0] != "Lavf58" || m.Freeform["iTunNORM"][0] != " 00000A2B" {
+		t.Errorf("unexpected metadata %+v\n", *m)
+	}
+	if len(m.Pictures) != 2 || m.Pictures[0].MIME != "image/png" ||
+		!bytes.Equal(m.Pictures[0].Data, png) || m.Pictures[1].MIME != "image/jpeg" {
+		t.Errorf("unexpected pictures %+v\n", m.Pictures)
+	}
+}
+
+func TestMp4Chapters(t *testing.T) {
+	mvhd := mp4Box("mvhd", u32s(0, 0, 0, 1000, 4000), make([]byte, 80))
+	audio := func(tref []byte) []byte {
+		return mp4Box("trak",
+			mp4Box("tkhd", u32s(3, 0, 0, 1, 0, 0), make([]byte, 60)),
+			tref,
+			mp4Box("mdia",
+				mp4Box("mdhd", u32s(0, 0, 0, 44100, 176400, 0)),
+				mp4Box("hdlr", u32s(0, 0), []byte("soun"), make([]byte, 13))))
+	}
+
+	// Nero chapters, start times in 100 ns units
+	chpl := mp4Box("chpl", []byte{1, 0, 0, 0}, u32s(0), []byte{2},
+		u32s(0, 0), []byte{5}, []byte("Intro"),
+		u32s(0, 15000000), []byte{6}, []byte("Second"))
+	nero := mp4Box("moov", mvhd, audio(nil), mp4Box("udta", chpl))
+
+	// QuickTime chapter track whose samples are stored in mdat
+	ftyp := mp4Box("ftyp", []byte("M4B "), u32s(0), []byte("M4B mp42"))
+	samples := append([]byte("\x00\x05Intro"), "\x00\x08\xfe\xff\x00H\x00i\x00!"...)
+	mdat := mp4Box("mdat", samples)
+	text := func(stsz []byte) []byte {
+		return mp4Box("trak",
+			mp4Box("tkhd", u32s(2, 0, 0, 2, 0, 0), make([]byte, 60)),
+			mp4Box("mdia",
+				mp4Box("mdhd", u32s(0, 0, 0, 1000, 4000, 0)),
+				mp4Box("hdlr", u32s(0, 0), []byte("text"), make([]byte, 13)),
+				mp4Box("minf", mp4Box("stbl",
+					mp4Box("stsd", u32s(0, 1), mp4Box("text", make([]byte, 52))),
+					mp4Box("stts", u32s(0, 2, 1, 1500, 1, 2500)),
+					stsz,
+					mp4Box("stsc", u32s(0, 1, 1, 2, 1)),
+					mp4Box("stco", u32s(0, 1, uint32(len(ftyp)+8)))))))
+	}
+	chap := audio(mp4Box("tref", mp4Box("chap", u32s(2))))
+	quickTime := append(append(ftyp, mdat...),
+		mp4Box("moov", mvhd, chap, text(mp4Box("stsz", u32s(0, 0, 2, 7, 10))))...)
+	// a constant sample size with a corrupt sample count is ignored
+	hugeStsz := append(append([]byte{}, ftyp...), append(mdat,
+		mp4Box("moov", mvhd, chap, text(mp4Box("stsz", u32s(0, 10, 0xFFFFFFFF))))...)...)
+
+	testSet := map[string]struct {
+		data     []byte
+		chapters []Mp4Chapter
+	}{
+		"Nero":      {nero, []Mp4Chapter{{"Intro", 0, 1.5}, {"Second", 1.5, 2.5}}},
+		"QuickTime": {quickTime, []Mp4Chapter{{"Intro", 0, 1.5}, {"Hi!", 1.5, 2.5}}},
+		"HugeStsz":  {hugeStsz, nil},
+	}
+	for k, v := range testSet {
+		if d, err := Mp4(bytes.NewReader(v.data)); err != nil || math.Abs(d-4) > delta {
+			t.Errorf("unexpected duration %v (%v) on item '%v'\n", d, err, k)
+		}
+		info, err := ParseMp4(bytes.NewReader(v.data))
+		fmt.Println(k, info.Chapters)
+		if err != nil {
+			t.Errorf("%s: %s\n", k, err)
+			continue
+		}
+		if math.Abs(info.Duration-4) > delta {
+			t.Errorf("too much error, expected '%v', found '%v' on item '%v'\n", 4, info.Duration, k)
+		}
+		if len(info.Chapters) != len(v.chapters) {
+			t.Errorf("expected %d chapters, found %d on item '%v'\n", len(v.chapters), len(info.Chapters), k)
+			continue
+		}
+		for i, c := range info.Chapters {
+			e := v.chapters[i]
+			if c.Title != e.Title || math.Abs(c.Start-e.Start) > delta || math.Abs(c.Duration-e.Duration) > delta {
+				t.Errorf("unexpected chapter %+v on item '%v'\n", c, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Core Audio Format specification
+// https://developer.apple.com/library/archive/documentation/MusicAudio/Reference/CAFSpec/CAF_spec/CAF_spec.html
+
+// CafInfo Stream properties of a caf file.
+type CafInfo struct {
+	FormatID         string // e.g. lpcm, aac , alac
+	FormatFlags      uint32
+	SampleRate       float64
+	BytesPerPacket   uint32 // 0 for variable packet sizes
+	FramesPerPacket  uint32 // 0 for variable frame counts
+	ChannelsPerFrame uint32
+	BitsPerChannel   uint32
+	// Packet table fields, for variable bitrate formats
+	Packets         int64
+	ValidFrames     int64
+	PrimingFrames   int32
+	RemainderFrames int32
+	DataSize        int64 // size of audio data, without the edit count
+	Duration        float64
+}
+
+// Caf Calculate caf files duration.
+func Caf(r io.ReadSeeker) (float64, error) {
+	info, err := ParseCaf(r)
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
+}
+
+// ParseCaf Parse the desc, pakt and data chunks of a caf file. The duration
+// comes from the packet table when present, otherwise from the data size of
+// constant bitrate formats.
+func ParseCaf(r io.ReadSeeker) (CafInfo, error) {
+	var info CafInfo
+	buf := make([]byte, 12)
+
+	// mFileType (4), mFileVersion (2), mFileFlags (2)
+	_, err := io.ReadFull(r, buf[0:8])
+	if err != nil {
+		return info, err
+	}
+	if string(buf[0:4]) != "caff" {
+		return info, errors.New("not caff")
+	}
+
+	hasDesc := false
+	hasPakt := false
+	hasData := false
+	for {
+		// mChunkType (4), mChunkSize (8)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return info, err
+		}
+		chunkType := string(buf[0:4])
+		chunkSize := int64(binary.BigEndian.Uint64(buf[4:12]))
+
+		switch chunkType {
+		case "desc":
+			if chunkSize < 32 {
+				return info, errors.New("invalid desc chunk")
+			}
+			descBuf := make([]byte, 32)
+			_, err = io.ReadFull(r, descBuf)
+			if err != nil {
+				return info, err
+			}
+			_, err = r.Seek(chunkSize-32, io.SeekCurrent)
+			if err != nil {
+				return info, err
+			}
+			info.SampleRate = math.Float64frombits(binary.BigEndian.Uint64(descBuf[0:8]))
+			info.FormatID = string(descBuf[8:12])
+			info.FormatFlags = binary.BigEndian.Uint32(descBuf[12:16])
+			info.BytesPerPacket = binary.BigEndian.Uint32(descBuf[16:20])
+			info.FramesPerPacket = binary.BigEndian.Uint32(descBuf[20:24])
+			info.ChannelsPerFrame = binary.BigEndian.Uint32(descBuf[24:28])
+			info.BitsPerChannel = binary.BigEndian.Uint32(descBuf[28:32])
+			hasDesc = true
+		case "pakt":
+			// mNumberPackets (8), mNumberValidFrames (8), mPrimingFrames (4),
+			// mRemainderFrames (4), packet table
+			if chunkSize < 24 {
+				return info, errors.New("invalid pakt chunk")
+			}
+			paktBuf := make([]byte, 24)
+			_, err = io.ReadFull(r, paktBuf)
+			if err != nil {
+				return info, err
+			}
+			info.Packets = int64(binary.BigEndian.Uint64(paktBuf[0:8]))
+			info.ValidFrames = int64(binary.BigEndian.Uint64(paktBuf[8:16]))
+			info.PrimingFrames = int32(binary.BigEndian.Uint32(paktBuf[16:20]))
+			info.RemainderFrames = int32(binary.BigEndian.Uint32(paktBuf[20:24]))
+			hasPakt = true
+			_, err = r.Seek(chunkSize-24, io.SeekCurrent)
+			if err != nil {
+				return info, err
+			}
+		case "data":
+			// mEditCount (4); -1 is the only valid negative size
+			if chunkSize != -1 && chunkSize < 4 {
+				return info, errors.New("invalid data chunk size")
+			}
+			hasData = true
+			if chunkSize == -1 {
+				// The data chunk extends to the end of file
+				cur, err := r.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return info, err
+				}
+				end, err := r.Seek(0, io.SeekEnd)
+				if err != nil {
+					return info, err
+				}
+				info.DataSize = end - cur - 4
+			} else {
+				info.DataSize = chunkSize - 4
+				_, err = r.Seek(chunkSize, io.SeekCurrent)
+				if err != nil {
+					return info, err
+				}
+			}
+		default:
+			if chunkSize < 0 {
+				return info, errors.New("invalid caf chunk size")
+			}
+			_, err = r.Seek(chunkSize, io.SeekCurrent)
+			if err != nil {
+				return info, err
+			}
+		}
+	}
+
+	if !hasDesc {
+		return info, errors.New("missing desc chunk")
+	}
+	if math.IsNaN(info.SampleRate) || math.IsInf(info.SampleRate, 0) || info.SampleRate <= 0 {
+		return info, errors.New("invalid sample rate")
+	}
+	var frames int64 = 0
+	switch {
+	case hasPakt && info.ValidFrames > 0:
+		frames = info.ValidFrames
+	case hasPakt && info.FramesPerPacket != 0:
+		frames = info.Packets*int64(info.FramesPerPacket) -
+			int64(info.PrimingFrames) - int64(info.RemainderFrames)
+	case hasData && info.BytesPerPacket != 0 && info.FramesPerPacket != 0:
+		frames = info.DataSize / int64(info.BytesPerPacket) * int64(info.FramesPerPacket)
+	default:
+		return info, errors.New("missing pakt chunk for variable bitrate caf")
+	}
+	info.Duration = float64(frames) / info.SampleRate
+	return info, nil
+}
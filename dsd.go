@@ -3,6 +3,7 @@ package audioduration
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -30,60 +31,353 @@ type fmtChunk struct {
 	// reserved       uint32
 }
 
-// DSD Calculate dsd files duration.
+// DsdInfo Stream properties of a dsd file (DSF or DSDIFF).
+type DsdInfo struct {
+	Container           string // DSF or DFF
+	Compression         string // DSD or DST
+	SampleRate          uint32
+	RateName            string // e.g. DSD64, DSD128, DSD256
+	Channels            uint32
+	ChannelType         uint32 // DSF channel type, 2 for stereo, 7 for 5.1
+	BitsPerSample       uint32 // DSF bit order: 1 for LSB first, 8 for MSB first
+	SampleCount         uint64 // samples per channel
+	BlockSizePerChannel uint32
+	Duration            float64
+	Tags                map[string]string // ID3v2 text frames, e.g. TIT2, TPE1
+}
+
+// dsdRateName Name a dsd sample rate as a multiple of 44.1 kHz or 48 kHz.
+func dsdRateName(sampleRate uint32) string {
+	switch {
+	case sampleRate == 0:
+		return ""
+	case sampleRate%44100 == 0:
+		return fmt.Sprintf("DSD%d", sampleRate/44100)
+	case sampleRate%48000 == 0:
+		return fmt.Sprintf("DSD%d", sampleRate/48000)
+	}
+	return ""
+}
+
+// DSD Calculate dsd files (DSF or DSDIFF) duration.
 func DSD(r io.ReadSeeker) (float64, error) {
-	var duration float64 = 0
+	info, err := parseDSD(r, false)
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
+}
+
+// ParseDSD Parse the chunks of a DSF or DSDIFF file and its ID3v2 tag.
+func ParseDSD(r io.ReadSeeker) (DsdInfo, error) {
+	return parseDSD(r, true)
+}
+
+// parseDSD Parse a dsd file, reading the ID3v2 tag of DSF files only when
+// withTags is set.
+func parseDSD(r io.ReadSeeker, withTags bool) (DsdInfo, error) {
+	var info DsdInfo
 	var err error
 	var dc dsdChunk
 	var fc fmtChunk
-	buf4 := make([]byte, 4)
-	buf8 := make([]byte, 8)
-	_, err = io.ReadFull(r, buf4)
+	buf := make([]byte, 52)
+	_, err = io.ReadFull(r, buf[0:4])
 	if err != nil {
-		return 0, err
+		return info, err
+	}
+	dc.header = string(buf[0:4])
+	if dc.header == "FRM8" {
+		err = dff(r, &info)
+		return info, err
 	}
-	dc.header = string(buf4)
 	if dc.header != "DSD " {
-		return 0, errors.New("not valid dsd file")
+		return info, errors.New("not valid dsd file")
 	}
-	_, err = io.ReadFull(r, buf8)
+	info.Container = "DSF"
+	info.Compression = "DSD"
+	// chunk size (8), total file size (8), pointer to metadata chunk (8)
+	_, err = io.ReadFull(r, buf[4:28])
 	if err != nil {
-		return 0, err
+		return info, err
+	}
+	dc.chunkSize = binary.LittleEndian.Uint64(buf[4:12])
+	dc.totalFileSize = binary.LittleEndian.Uint64(buf[12:20])
+	dc.metadatePtr = binary.LittleEndian.Uint64(buf[20:28])
+	if dc.chunkSize < 28 {
+		return info, errors.New("invalid dsd chunk size")
 	}
-	dc.chunkSize = binary.LittleEndian.Uint64(buf8)
-	r.Seek(int64(dc.chunkSize-12), io.SeekCurrent)
-	_, err = io.ReadFull(r, buf4)
+	if _, err = r.Seek(int64(dc.chunkSize), io.SeekStart); err != nil {
+		return info, err
+	}
+
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
-		return 0, err
+		return info, err
 	}
-	fc.header = string(buf4)
+	fc.header = string(buf[0:4])
 	if fc.header != "fmt " {
-		return 0, errors.New("not valid dsd file")
+		return info, errors.New("not valid dsd file")
+	}
+	fc.chunkSize = binary.LittleEndian.Uint64(buf[4:12])
+	fc.formatVer = binary.LittleEndian.Uint32(buf[12:16])
+	fc.formatID = binary.LittleEndian.Uint32(buf[16:20])
+	fc.channelType = binary.LittleEndian.Uint32(buf[20:24])
+	fc.channelNum = binary.LittleEndian.Uint32(buf[24:28])
+	fc.sampleFreq = binary.LittleEndian.Uint32(buf[28:32])
+	fc.bitPerSec = binary.LittleEndian.Uint32(buf[32:36])
+	fc.sampleCount = binary.LittleEndian.Uint64(buf[36:44])
+	fc.blockSizePerCh = binary.LittleEndian.Uint32(buf[44:48])
+	// 0: DSD raw, the only format defined
+	if fc.formatID != 0 {
+		return info, errors.New("unsupported dsd format id")
+	}
+	if fc.sampleFreq == 0 || fc.channelNum == 0 || fc.blockSizePerCh == 0 {
+		return info, errors.New("invalid dsd fmt chunk")
+	}
+	if fc.bitPerSec != 1 && fc.bitPerSec != 8 {
+		return info, errors.New("invalid dsd bit order")
+	}
+	info.SampleRate = fc.sampleFreq
+	info.RateName = dsdRateName(fc.sampleFreq)
+	info.Channels = fc.channelNum
+	info.ChannelType = fc.channelType
+	info.BitsPerSample = fc.bitPerSec
+	info.SampleCount = fc.sampleCount
+	info.BlockSizePerChannel = fc.blockSizePerCh
+	info.Duration = float64(fc.sampleCount) / float64(fc.sampleFreq)
+
+	// data chunk: header (4), chunk size (8), sample data. Each channel is
+	// stored in blocks of blockSizePerCh bytes, the last block zero padded.
+	// DSD samples are 1 bit whatever the bit order.
+	if _, err = r.Seek(int64(dc.chunkSize+fc.chunkSize), io.SeekStart); err != nil {
+		return info, err
 	}
-	_, err = io.ReadFull(r, buf8)
+	_, err = io.ReadFull(r, buf[0:12])
 	if err != nil {
-		return 0, err
+		return info, err
+	}
+	if string(buf[0:4]) != "data" {
+		return info, errors.New("missing dsd data chunk")
 	}
-	for i := 0; i < 4; i++ {
-		_, err = io.ReadFull(r, buf4)
+	dataSize := binary.LittleEndian.Uint64(buf[4:12])
+	bytesPerCh := (fc.sampleCount + 7) / 8
+	blocks := (bytesPerCh + uint64(fc.blockSizePerCh) - 1) / uint64(fc.blockSizePerCh)
+	if dataSize < 12+blocks*uint64(fc.blockSizePerCh)*uint64(fc.channelNum) {
+		return info, errors.New("dsd data chunk shorter than sample count")
+	}
+
+	if withTags && dc.metadatePtr != 0 {
+		info.Tags, err = readDsfID3v2(r, int64(dc.metadatePtr))
 		if err != nil {
-			return 0, err
+			return info, err
 		}
 	}
-	_, err = io.ReadFull(r, buf4)
+	return info, nil
+}
+
+// dsfMaxTagSize Upper limit of the ID3v2 tag read into memory.
+const dsfMaxTagSize = 16 << 20
+
+// readDsfID3v2 Read the text frames of the ID3v2 tag at offset. A malformed
+// or oversized tag is ignored, a failing reader is not.
+func readDsfID3v2(r io.ReadSeeker, offset int64) (map[string]string, error) {
+	end, err := r.Seek(0, io.SeekEnd)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	fc.sampleFreq = binary.LittleEndian.Uint32(buf4)
-	_, err = io.ReadFull(r, buf4)
+	if offset < 0 || offset+10 > end {
+		return nil, nil
+	}
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(r, head); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if string(head[0:3]) != "ID3" {
+		return nil, nil
+	}
+	size := parseID3v2Length(head)
+	if size > dsfMaxTagSize {
+		return nil, nil
+	}
+	// the tag may be truncated
+	if size > end-offset-10 {
+		size = end - offset - 10
+	}
+	tag := make([]byte, 10+size)
+	copy(tag, head)
+	n, err := io.ReadFull(r, tag[10:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	tags, err := parseID3v2Text(tag[:10+n])
 	if err != nil {
-		return 0, err
+		return nil, nil
+	}
+	return tags, nil
+}
+
+// DSDIFF format specification
+// https://dsd-guide.com/sites/default/files/white-papers/DSDIFF_1.5_Spec.pdf
+
+// dffChunkHeader Read the ID and the 64-bit big endian size of a chunk.
+func dffChunkHeader(r io.Reader) (string, uint64, error) {
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", 0, err
 	}
-	_, err = io.ReadFull(r, buf8)
+	return string(buf[0:4]), binary.BigEndian.Uint64(buf[4:12]), nil
+}
+
+// dffSkipTo Seek to the end of a chunk content starting at start, including
+// the padding byte.
+func dffSkipTo(r io.ReadSeeker, start int64, size uint64) error {
+	_, err := r.Seek(start+int64(size+size%2), io.SeekStart)
+	return err
+}
+
+// dff Parse dsdiff files into info. The reader is expected right after the
+// 'FRM8' ID.
+func dff(r io.ReadSeeker, info *DsdInfo) error {
+	buf := make([]byte, 12)
+	// form size (8), form type (4)
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if string(buf[8:12]) != "DSD " {
+		return errors.New("not valid dsdiff file")
+	}
+	info.Container = "DFF"
+
+	var sampleRate uint32 = 0
+	var channels uint16 = 0
+	var dsdSize uint64 = 0
+	// compression type of the CMPR chunk, "DSD " or "DST "
+	compression := ""
+	hasDsd := false
+	for {
+		id, size, err := dffChunkHeader(r)
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return err
+		}
+		start, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		switch id {
+		case "PROP":
+			// property type (4), local chunks
+			_, err = io.ReadFull(r, buf[0:4])
+			if err != nil {
+				return err
+			}
+			if string(buf[0:4]) != "SND " {
+				break
+			}
+			propEnd := start + int64(size)
+			for {
+				cur, err := r.Seek(0, io.SeekCurrent)
+				if err != nil {
+					return err
+				}
+				if cur+12 > propEnd {
+					break
+				}
+				subID, subSize, err := dffChunkHeader(r)
+				if err != nil {
+					return err
+				}
+				switch subID {
+				case "FS  ":
+					// sample rate (4)
+					_, err = io.ReadFull(r, buf[0:4])
+					if err != nil {
+						return err
+					}
+					sampleRate = binary.BigEndian.Uint32(buf[0:4])
+				case "CHNL":
+					// number of channels (2), channel IDs
+					_, err = io.ReadFull(r, buf[0:2])
+					if err != nil {
+						return err
+					}
+					channels = binary.BigEndian.Uint16(buf[0:2])
+				case "CMPR":
+					// compression type (4), name length (1), name
+					_, err = io.ReadFull(r, buf[0:4])
+					if err != nil {
+						return err
+					}
+					compression = string(buf[0:4])
+				}
+				if err := dffSkipTo(r, cur+12, subSize); err != nil {
+					return err
+				}
+			}
+		case "DSD ":
+			hasDsd = true
+			dsdSize = size
+		case "DST ":
+			if compression != "" && compression != id {
+				return errors.New("dsdiff compression mismatch")
+			}
+			if sampleRate == 0 || channels == 0 {
+				return errors.New("missing dsdiff sound properties")
+			}
+			// The DST sound data starts with the FRTE chunk holding the
+			// number of frames (4) and the frame rate (2)
+			subID, _, err := dffChunkHeader(r)
+			if err != nil {
+				return err
+			}
+			if subID != "FRTE" {
+				return errors.New("missing dst frame information")
+			}
+			_, err = io.ReadFull(r, buf[0:6])
+			if err != nil {
+				return err
+			}
+			frames := binary.BigEndian.Uint32(buf[0:4])
+			frameRate := binary.BigEndian.Uint16(buf[4:6])
+			if frameRate == 0 {
+				return errors.New("invalid dst frame rate")
+			}
+			info.Compression = "DST"
+			info.SampleRate = sampleRate
+			info.RateName = dsdRateName(sampleRate)
+			info.Channels = uint32(channels)
+			info.SampleCount = uint64(frames) * uint64(sampleRate) / uint64(frameRate)
+			info.Duration = float64(frames) / float64(frameRate)
+			return nil
+		}
+		if err := dffSkipTo(r, start, size); err != nil {
+			return err
+		}
+	}
+
+	if !hasDsd {
+		return errors.New("missing dsd sound data chunk")
+	}
+	if compression != "" && compression != "DSD " {
+		return errors.New("dsdiff compression mismatch")
+	}
+	if sampleRate == 0 || channels == 0 {
+		return errors.New("missing dsdiff sound properties")
 	}
-	fc.sampleCount = binary.LittleEndian.Uint64(buf8)
-	duration = float64(fc.sampleCount) / float64(fc.sampleFreq)
-	return duration, nil
+	info.Compression = "DSD"
+	info.SampleRate = sampleRate
+	info.RateName = dsdRateName(sampleRate)
+	info.Channels = uint32(channels)
+	info.SampleCount = dsdSize * 8 / uint64(channels)
+	info.Duration = float64(info.SampleCount) / float64(sampleRate)
+	return nil
 }
@@ -1,6 +1,7 @@
 package audioduration
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -8,40 +9,646 @@ import (
 
 // https://xiph.org/flac/format.html#metadata_block_streaminfo
 
-// FLAC Calculate flac files duration.
-func FLAC(r io.ReadSeeker) (float64, error) {
+// flacStreamInfo The struct for flac STREAMINFO metadata block.
+type flacStreamInfo struct {
+	minBlockSize  uint16
+	maxBlockSize  uint16
+	minFrameSize  uint32
+	maxFrameSize  uint32
+	sampleRate    uint32
+	channels      uint8
+	bitsPerSample uint8
+	totalSamples  uint64
+}
+
+func parseFlacStreamInfo(buf []byte) (flacStreamInfo, error) {
+	var si flacStreamInfo
+	if len(buf) < 18 {
+		return si, errors.New("invalid flac streaminfo size")
+	}
+	si.minBlockSize = binary.BigEndian.Uint16(buf[0:2])
+	si.maxBlockSize = binary.BigEndian.Uint16(buf[2:4])
+	si.minFrameSize = binary.BigEndian.Uint32(append([]byte{0}, buf[4:7]...))
+	si.maxFrameSize = binary.BigEndian.Uint32(append([]byte{0}, buf[7:10]...))
+	si.sampleRate = binary.BigEndian.Uint32(
+		append([]byte{0}, buf[10:13]...)) >> 4
+	si.channels = (buf[12]>>1)&0x07 + 1
+	si.bitsPerSample = ((buf[12]&0x01)<<4 | buf[13]>>4) + 1
+	si.totalSamples = binary.BigEndian.Uint64(
+		append([]byte{0, 0, 0}, buf[13:18]...)) & 0xfffffffff
+	return si, nil
+}
+
+// https://xiph.org/flac/format.html#metadata_block_seektable
+
+// FLACSeekPoint A seek point of flac SEEKTABLE.
+type FLACSeekPoint struct {
+	SampleNumber uint64 // sample number of the first sample in the target frame
+	Offset       uint64 // byte offset from the first frame header to the target frame
+	FrameSamples uint16 // number of samples in the target frame
+}
+
+const flacPlaceholderPoint = 0xFFFFFFFFFFFFFFFF
+
+func parseFlacSeekTable(buf []byte) []FLACSeekPoint {
+	points := []FLACSeekPoint{}
+	for i := 0; i+18 <= len(buf); i += 18 {
+		sampleNum := binary.BigEndian.Uint64(buf[i : i+8])
+		if sampleNum == flacPlaceholderPoint {
+			continue
+		}
+		points = append(points, FLACSeekPoint{
+			SampleNumber: sampleNum,
+			Offset:       binary.BigEndian.Uint64(buf[i+8 : i+16]),
+			FrameSamples: binary.BigEndian.Uint16(buf[i+16 : i+18]),
+		})
+	}
+	return points
+}
+
+// https://xiph.org/flac/format.html#metadata_block_cuesheet
+
+// FLACCueIndex An index point of a cue sheet track.
+type FLACCueIndex struct {
+	Number uint8
+	Offset uint64  // offset in samples relative to the track offset
+	Time   float64 // start time in seconds from the beginning of the stream
+}
+
+// FLACCueTrack A track of flac CUESHEET.
+type FLACCueTrack struct {
+	Number      uint8
+	Offset      uint64 // offset in samples from the beginning of the stream
+	ISRC        string
+	IsAudio     bool
+	PreEmphasis bool
+	Indices     []FLACCueIndex
+	Start       float64 // start time in seconds, at index 01 when present
+	Duration    float64 // seconds until the start of the next track or lead-out
+}
+
+// FLACCueSheet The content of flac CUESHEET, without the lead-out track.
+type FLACCueSheet struct {
+	MediaCatalogNumber string
+	LeadInSamples      uint64
+	IsCD               bool
+	LeadOutOffset      uint64 // offset in samples of the lead-out track
+	Tracks             []FLACCueTrack
+}
+
+func parseFlacCueSheet(buf []byte, sampleRate uint32) (*FLACCueSheet, error) {
+	errInvalid := errors.New("invalid flac cuesheet")
+	if len(buf) < 396 {
+		return nil, errInvalid
+	}
+	cs := &FLACCueSheet{}
+	cs.MediaCatalogNumber = string(bytes.TrimRight(buf[0:128], "\x00"))
+	cs.LeadInSamples = binary.BigEndian.Uint64(buf[128:136])
+	cs.IsCD = buf[136]&0x80 != 0
+	trackNum := int(buf[395])
+	pos := 396
+	var tracks []FLACCueTrack
+	for i := 0; i < trackNum; i++ {
+		if pos+36 > len(buf) {
+			return nil, errInvalid
+		}
+		var t FLACCueTrack
+		t.Offset = binary.BigEndian.Uint64(buf[pos : pos+8])
+		t.Number = buf[pos+8]
+		t.ISRC = string(bytes.TrimRight(buf[pos+9:pos+21], "\x00"))
+		t.IsAudio = buf[pos+21]&0x80 == 0
+		t.PreEmphasis = buf[pos+21]&0x40 != 0
+		indexNum := int(buf[pos+35])
+		pos += 36
+		if pos+12*indexNum > len(buf) {
+			return nil, errInvalid
+		}
+		t.Indices = []FLACCueIndex{}
+		for j := 0; j < indexNum; j++ {
+			var idx FLACCueIndex
+			idx.Offset = binary.BigEndian.Uint64(buf[pos : pos+8])
+			idx.Number = buf[pos+8]
+			t.Indices = append(t.Indices, idx)
+			pos += 12
+		}
+		tracks = append(tracks, t)
+	}
+	if len(tracks) == 0 {
+		return nil, errInvalid
+	}
+	// The last track is the lead-out track
+	cs.LeadOutOffset = tracks[len(tracks)-1].Offset
+	cs.Tracks = tracks[:len(tracks)-1]
+
+	if sampleRate != 0 {
+		rate := float64(sampleRate)
+		for i := range cs.Tracks {
+			t := &cs.Tracks[i]
+			start := t.Offset
+			for j := range t.Indices {
+				idx := &t.Indices[j]
+				idx.Time = float64(t.Offset+idx.Offset) / rate
+				if idx.Number == 1 {
+					start = t.Offset + idx.Offset
+				}
+			}
+			t.Start = float64(start) / rate
+		}
+		for i := range cs.Tracks {
+			end := float64(cs.LeadOutOffset) / rate
+			if i+1 < len(cs.Tracks) {
+				end = cs.Tracks[i+1].Start
+			}
+			cs.Tracks[i].Duration = end - cs.Tracks[i].Start
+		}
+	}
+	return cs, nil
+}
+
+// flacMetadata Metadata blocks of a flac stream that we are interested in.
+type flacMetadata struct {
+	streamInfo flacStreamInfo
+	seekPoints []FLACSeekPoint
+	cueSheet   *FLACCueSheet
+}
+
+// readFlacMetadata Read the metadata blocks after the 'fLaC' marker. With
+// withMetadata all blocks are read and on success the reader is positioned at
+// the first audio frame; otherwise it stops after STREAMINFO.
+func readFlacMetadata(r io.ReadSeeker, withMetadata bool) (flacMetadata, error) {
+	var meta flacMetadata
 	buf := make([]byte, 4)
 	_, err := io.ReadFull(r, buf)
 	if err != nil {
-		return 0, err
+		return meta, err
 	}
-	hdr := string(buf)
-	if hdr != "fLaC" {
-		return 0, errors.New("expected 'fLaC' at file start")
+	if string(buf) != "fLaC" {
+		return meta, errors.New("expected 'fLaC' at file start")
 	}
-	var duration float64 = 0
+	var cueBuf []byte
+	first := true
 	for {
 		_, err = io.ReadFull(r, buf)
 		if err != nil {
-			break
+			return meta, err
 		}
+		isLast := buf[0]&0x80 != 0
 		blockType := buf[0] & 0x7f
 		var blockSize uint32 = binary.BigEndian.Uint32(buf) & 0x00FFFFFF
-		if blockType == 0 { // Metadata block type is Streaminfo
+		if first && blockType != 0 {
+			return meta, errors.New("unexpected block type")
+		}
+		first = false
+		switch blockType {
+		case 0: // Streaminfo
 			streamInfoBuf := make([]byte, blockSize)
 			_, err = io.ReadFull(r, streamInfoBuf)
 			if err != nil {
-				break
+				return meta, err
+			}
+			meta.streamInfo, err = parseFlacStreamInfo(streamInfoBuf)
+			if err != nil {
+				return meta, err
+			}
+			if !withMetadata {
+				return meta, nil
 			}
-			sampleRate := binary.BigEndian.Uint32(
-				append([]byte{0}, streamInfoBuf[10:13]...)) >> 4
-			totalSamples := binary.BigEndian.Uint64(
-				append([]byte{0, 0, 0}, streamInfoBuf[13:18]...)) & 0x7ffffffff
-			duration = float64(totalSamples) / float64(sampleRate)
+		case 3: // Seektable
+			seekBuf := make([]byte, blockSize)
+			_, err = io.ReadFull(r, seekBuf)
+			if err != nil {
+				return meta, err
+			}
+			meta.seekPoints = parseFlacSeekTable(seekBuf)
+		case 5: // Cuesheet
+			cueBuf = make([]byte, blockSize)
+			_, err = io.ReadFull(r, cueBuf)
+			if err != nil {
+				return meta, err
+			}
+		default:
+			_, err = r.Seek(int64(blockSize), io.SeekCurrent)
+			if err != nil {
+				return meta, err
+			}
+		}
+		if isLast {
 			break
+		}
+	}
+	// Track times depend on the sample rate, so parse the cuesheet last
+	if cueBuf != nil {
+		meta.cueSheet, err = parseFlacCueSheet(cueBuf, meta.streamInfo.sampleRate)
+		if err != nil {
+			return meta, err
+		}
+	}
+	return meta, nil
+}
+
+// FLACInfo Stream properties and seek/cue information of a flac file.
+type FLACInfo struct {
+	SampleRate       uint32
+	Channels         uint8
+	BitsPerSample    uint8
+	TotalSamples     uint64
+	Duration         float64
+	FirstFrameOffset int64 // file offset of the first audio frame
+	SeekPoints       []FLACSeekPoint
+	CueSheet         *FLACCueSheet // nil if the file has no CUESHEET
+}
+
+// ParseFLAC Read all metadata blocks of a flac file, including SEEKTABLE and
+// CUESHEET.
+func ParseFLAC(r io.ReadSeeker) (FLACInfo, error) {
+	var info FLACInfo
+	meta, err := readFlacMetadata(r, true)
+	if err != nil {
+		return info, err
+	}
+	info.FirstFrameOffset, err = r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return info, err
+	}
+	si := meta.streamInfo
+	info.SampleRate = si.sampleRate
+	info.Channels = si.channels
+	info.BitsPerSample = si.bitsPerSample
+	info.TotalSamples = si.totalSamples
+	if si.sampleRate != 0 {
+		info.Duration = float64(si.totalSamples) / float64(si.sampleRate)
+	}
+	info.SeekPoints = meta.seekPoints
+	info.CueSheet = meta.cueSheet
+	return info, nil
+}
+
+// SeekOffset Find the seek point at or before the given time. It returns the
+// sample number of the seek point and the file offset of its frame.
+func (info FLACInfo) SeekOffset(seconds float64) (uint64, int64, bool) {
+	if info.SampleRate == 0 || len(info.SeekPoints) == 0 {
+		return 0, 0, false
+	}
+	target := uint64(seconds * float64(info.SampleRate))
+	found := false
+	var best FLACSeekPoint
+	for _, p := range info.SeekPoints {
+		if p.SampleNumber > target {
+			break
+		}
+		best = p
+		found = true
+	}
+	if !found {
+		return 0, 0, false
+	}
+	return best.SampleNumber, info.FirstFrameOffset + int64(best.Offset), true
+}
+
+// FLAC Calculate flac files duration. Ogg-encapsulated FLAC is handled by Ogg.
+func FLAC(r io.ReadSeeker) (float64, error) {
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+	hdr := string(buf)
+	if hdr == "OggS" {
+		if _, err := r.Seek(-4, io.SeekCurrent); err != nil {
+			return 0, err
+		}
+		info, err := parseOgg(r, false)
+		if err != nil {
+			return 0, err
+		}
+		if info.Codec != "flac" {
+			return 0, errors.New("ogg stream is not flac")
+		}
+		return info.Duration, nil
+	}
+	if _, err := r.Seek(-4, io.SeekCurrent); err != nil {
+		return 0, err
+	}
+	meta, err := readFlacMetadata(r, false)
+	if err != nil {
+		return 0, err
+	}
+	si := meta.streamInfo
+	if si.sampleRate == 0 {
+		return 0, errors.New("invalid flac sample rate")
+	}
+	return float64(si.totalSamples) / float64(si.sampleRate), nil
+}
+
+// https://xiph.org/flac/format.html#frame_header
+
+// flacFrameHeader The fields of a flac frame header needed to walk frames.
+type flacFrameHeader struct {
+	blockSize   uint64
+	firstSample uint64
+}
+
+// flacMaxFrameHeaderLen sync(2) + codes(2) + utf8 number(7) + blocksize(2)
+// + samplerate(2) + crc8(1)
+const flacMaxFrameHeaderLen = 16
+
+// parseFlacFrameHeader Parse the frame header at the start of b and validate
+// its CRC-8. ok is false when b does not hold a valid frame header.
+func parseFlacFrameHeader(b []byte, si flacStreamInfo) (hdr flacFrameHeader, ok bool) {
+	if len(b) < 6 || b[0] != 0xFF || b[1]&0xFE != 0xF8 {
+		return hdr, false
+	}
+	variable := b[1]&0x01 == 1
+	bsCode := b[2] >> 4
+	srCode := b[2] & 0x0F
+	chCode := b[3] >> 4
+	ssCode := (b[3] >> 1) & 0x07
+	if bsCode == 0 || srCode == 0x0F || chCode > 10 || ssCode == 3 || b[3]&0x01 != 0 {
+		return hdr, false
+	}
+
+	// UTF-8 like coded frame or sample number
+	n := 4
+	lead := b[n]
+	var extra int
+	var num uint64
+	switch {
+	case lead&0x80 == 0:
+		extra, num = 0, uint64(lead)
+	case lead&0xE0 == 0xC0:
+		extra, num = 1, uint64(lead&0x1F)
+	case lead&0xF0 == 0xE0:
+		extra, num = 2, uint64(lead&0x0F)
+	case lead&0xF8 == 0xF0:
+		extra, num = 3, uint64(lead&0x07)
+	case lead&0xFC == 0xF8:
+		extra, num = 4, uint64(lead&0x03)
+	case lead&0xFE == 0xFC:
+		extra, num = 5, uint64(lead&0x01)
+	case lead == 0xFE:
+		extra, num = 6, 0
+	default:
+		return hdr, false
+	}
+	n++
+	if len(b) < n+extra {
+		return hdr, false
+	}
+	for i := 0; i < extra; i++ {
+		if b[n]&0xC0 != 0x80 {
+			return hdr, false
+		}
+		num = num<<6 | uint64(b[n]&0x3F)
+		n++
+	}
+
+	switch {
+	case bsCode == 1:
+		hdr.blockSize = 192
+	case bsCode <= 5:
+		hdr.blockSize = 576 << (bsCode - 2)
+	case bsCode == 6:
+		if len(b) < n+1 {
+			return hdr, false
+		}
+		hdr.blockSize = uint64(b[n]) + 1
+		n++
+	case bsCode == 7:
+		if len(b) < n+2 {
+			return hdr, false
+		}
+		hdr.blockSize = uint64(binary.BigEndian.Uint16(b[n:n+2])) + 1
+		n += 2
+	default:
+		hdr.blockSize = 256 << (bsCode - 8)
+	}
+	switch srCode {
+	case 12:
+		n++
+	case 13, 14:
+		n += 2
+	}
+	if len(b) < n+1 {
+		return hdr, false
+	}
+	if flacCRC8(b[:n]) != b[n] {
+		return hdr, false
+	}
+	if variable {
+		hdr.firstSample = num
+	} else {
+		fixed := uint64(si.maxBlockSize)
+		if fixed == 0 {
+			fixed = hdr.blockSize
+		}
+		hdr.firstSample = num * fixed
+	}
+	return hdr, true
+}
+
+func flacCRC8(b []byte) uint8 {
+	var crc uint8 = 0
+	for _, v := range b {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func flacCRC16(b []byte) uint16 {
+	var crc uint16 = 0
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// flacScanner A sliding window over the audio frames of a flac file.
+type flacScanner struct {
+	r    io.ReadSeeker
+	base int64 // file offset of buf[0]
+	end  int64 // file offset where audio frames end
+	buf  []byte
+}
+
+// fill Make the window hold data up to file offset off (or the end of audio).
+func (s *flacScanner) fill(off int64) error {
+	if off > s.end {
+		off = s.end
+	}
+	have := s.base + int64(len(s.buf))
+	if off <= have {
+		return nil
+	}
+	chunk := off - have
+	if chunk < 65536 {
+		chunk = 65536
+	}
+	if have+chunk > s.end {
+		chunk = s.end - have
+	}
+	more := make([]byte, chunk)
+	if _, err := s.r.Seek(have, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(s.r, more); err != nil {
+		return err
+	}
+	s.buf = append(s.buf, more...)
+	return nil
+}
+
+// bytes Return the window content between file offsets from and to.
+func (s *flacScanner) bytes(from, to int64) []byte {
+	if to > s.base+int64(len(s.buf)) {
+		to = s.base + int64(len(s.buf))
+	}
+	return s.buf[from-s.base : to-s.base]
+}
+
+// discard Drop buffered data before file offset off.
+func (s *flacScanner) discard(off int64) {
+	s.buf = s.buf[off-s.base:]
+	s.base = off
+}
+
+// FLACVerifyResult The result of walking all frames of a flac file.
+type FLACVerifyResult struct {
+	Frames       int     // number of frames found
+	BadFrames    []int64 // byte offsets of frames failing CRC-8 or CRC-16
+	TotalSamples uint64  // total samples declared in STREAMINFO
+	EndSample    uint64  // sample number following the final valid frame
+	SamplesMatch bool    // EndSample equals TotalSamples
+}
+
+// Valid Report whether all frames passed the checks and the sample count
+// matches STREAMINFO.
+func (v FLACVerifyResult) Valid() bool {
+	return len(v.BadFrames) == 0 && v.SamplesMatch
+}
+
+// VerifyFLAC Walk every frame of a flac file, validating the header CRC-8
+// and frame CRC-16 without decoding the audio.
+func VerifyFLAC(r io.ReadSeeker) (FLACVerifyResult, error) {
+	var res FLACVerifyResult
+	meta, err := readFlacMetadata(r, true)
+	if err != nil {
+		return res, err
+	}
+	si := meta.streamInfo
+	res.TotalSamples = si.totalSamples
+
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return res, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return res, err
+	}
+	// Exclude a trailing ID3v1 tag from the last frame
+	if end-start >= 128 {
+		tag := make([]byte, 3)
+		if _, err := r.Seek(end-128, io.SeekStart); err != nil {
+			return res, err
+		}
+		if _, err := io.ReadFull(r, tag); err != nil {
+			return res, err
+		}
+		if string(tag) == "TAG" {
+			end -= 128
+		}
+	}
+
+	// Upper bound of a frame size, used to limit the search for the next
+	// frame header.
+	limit := int64(si.maxFrameSize)
+	if limit == 0 {
+		limit = int64(si.maxBlockSize)*int64(si.channels)*int64(si.bitsPerSample)/8 + flacMaxFrameHeaderLen + 2
+	}
+
+	s := &flacScanner{r: r, base: start, end: end}
+	pos := start
+	var expected uint64 = 0
+	for pos < end {
+		if err := s.fill(pos + flacMaxFrameHeaderLen); err != nil {
+			return res, err
+		}
+		hdr, ok := parseFlacFrameHeader(s.bytes(pos, pos+flacMaxFrameHeaderLen), si)
+		if ok {
+			expected = hdr.firstSample + hdr.blockSize
+		}
+
+		// Search the next frame header. An exact sample number match or a
+		// valid CRC-16 confirms the frame boundary; otherwise fall back to the
+		// first later frame header to resync after corrupted data.
+		next := end
+		fallback := int64(-1)
+		q := pos + 2
+		for ; q+1 < end; q++ {
+			if q-pos > 2*limit && fallback >= 0 {
+				break
+			}
+			if err := s.fill(q + flacMaxFrameHeaderLen); err != nil {
+				return res, err
+			}
+			b := s.bytes(q, q+flacMaxFrameHeaderLen)
+			if b[0] != 0xFF || b[1]&0xFE != 0xF8 {
+				continue
+			}
+			cand, cok := parseFlacFrameHeader(b, si)
+			if !cok {
+				continue
+			}
+			if ok && cand.firstSample == expected {
+				next = q
+				break
+			}
+			if ok && flacFrameCRCValid(s.bytes(pos, q)) {
+				next = q
+				break
+			}
+			if fallback < 0 && cand.firstSample >= expected {
+				fallback = q
+			}
+		}
+		if next == end && fallback >= 0 {
+			next = fallback
+		}
+		if err := s.fill(next); err != nil {
+			return res, err
+		}
+
+		res.Frames++
+		if !ok || !flacFrameCRCValid(s.bytes(pos, next)) {
+			res.BadFrames = append(res.BadFrames, pos)
 		} else {
-			return 0, errors.New("unexpected block type")
+			res.EndSample = expected
 		}
+		s.discard(next)
+		pos = next
+	}
+	res.SamplesMatch = res.EndSample == res.TotalSamples
+	return res, nil
+}
+
+func flacFrameCRCValid(frame []byte) bool {
+	n := len(frame)
+	if n < 2 {
+		return false
 	}
-	return duration, err
+	return flacCRC16(frame[:n-2]) == binary.BigEndian.Uint16(frame[n-2:])
 }
@@ -0,0 +1,244 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"testing"
+)
+
+// Builders of synthetic files for the formats and corner cases the samples
+// don't cover.
+
+// countingReader Count the bytes read through a ReadSeeker.
+type countingReader struct {
+	io.ReadSeeker
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.n += n
+	return n, err
+}
+
+// failingReader Fail the reads at or after a file offset.
+type failingReader struct {
+	io.ReadSeeker
+	from int64
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if pos >= f.from {
+		return 0, errors.New("read failed")
+	}
+	return f.ReadSeeker.Read(p)
+}
+
+// u32s Encode big endian 32-bit values.
+func u32s(v ...uint32) []byte {
+	var b []byte
+	for _, x := range v {
+		b = binary.BigEndian.AppendUint32(b, x)
+	}
+	return b
+}
+
+// iffChunk Build a chunk of the IFF family: an ID, a size field of sizeLen
+// bytes and the content with its padding byte.
+func iffChunk(order binary.AppendByteOrder, sizeLen int, id string, content []byte) []byte {
+	chunk := []byte(id)
+	if sizeLen == 8 {
+		chunk = order.AppendUint64(chunk, uint64(len(content)))
+	} else {
+		chunk = order.AppendUint32(chunk, uint32(len(content)))
+	}
+	chunk = append(chunk, content...)
+	if len(content)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// riffChunk Build a RIFF chunk with its padding byte.
+func riffChunk(id string, content []byte) []byte {
+	return iffChunk(binary.LittleEndian, 4, id, content)
+}
+
+// aiffChunk Build a big endian IFF chunk with its padding byte.
+func aiffChunk(id string, content []byte) []byte {
+	return iffChunk(binary.BigEndian, 4, id, content)
+}
+
+// dffChunk Build a dsdiff chunk with its padding byte.
+func dffChunk(id string, content []byte) []byte {
+	return iffChunk(binary.BigEndian, 8, id, content)
+}
+
+// w64Chunk Build a Wave64 chunk, whose size includes the 24 bytes header,
+// padded to 8 bytes.
+func w64Chunk(guid string, content []byte) []byte {
+	c := []byte(guid)
+	c = binary.LittleEndian.AppendUint64(c, uint64(24+len(content)))
+	c = append(c, content...)
+	for len(c)%8 != 0 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+// cafChunk Build a caf chunk. The size is given to allow -1 for data chunks
+// running to the end of file.
+func cafChunk(typ string, size int64, content []byte) []byte {
+	chunk := []byte(typ)
+	chunk = binary.BigEndian.AppendUint64(chunk, uint64(size))
+	return append(chunk, content...)
+}
+
+// wavFile Build a RIFF/WAVE file from chunks.
+func wavFile(chunks ...[]byte) []byte {
+	body := []byte("WAVE")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	return riffChunk("RIFF", body)
+}
+
+// wavFmt Build the content of a fmt chunk.
+func wavFmt(format, channels uint16, rate, byteRate uint32, blockAlign, bits uint16, ext []byte) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, format)
+	b = binary.LittleEndian.AppendUint16(b, channels)
+	b = binary.LittleEndian.AppendUint32(b, rate)
+	b = binary.LittleEndian.AppendUint32(b, byteRate)
+	b = binary.LittleEndian.AppendUint16(b, blockAlign)
+	b = binary.LittleEndian.AppendUint16(b, bits)
+	if ext != nil {
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(ext)))
+		b = append(b, ext...)
+	}
+	return b
+}
+
+// extended Encode a positive integer as 80-bit IEEE 754 extended precision.
+func extended(v uint64) []byte {
+	exp := 63
+	for v&(1<<63) == 0 {
+		v <<= 1
+		exp--
+	}
+	b := binary.BigEndian.AppendUint16(nil, uint16(16383+exp))
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+// cafDesc Build the content of a desc chunk.
+func cafDesc(rate float64, format string, bytesPerPacket, framesPerPacket, channels, bits uint32) []byte {
+	b := binary.BigEndian.AppendUint64(nil, math.Float64bits(rate))
+	b = append(b, format...)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	for _, v := range []uint32{bytesPerPacket, framesPerPacket, channels, bits} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// flacWithBlocks Rebuild the sample flac with extra metadata blocks inserted
+// after STREAMINFO.
+func flacWithBlocks(t *testing.T, blocks map[byte][]byte, order []byte) []byte {
+	data, err := os.ReadFile("samples/sample.flac")
+	if err != nil {
+		t.Fatalf("Sample FLAC file: %s.\n", err)
+	}
+	out := append([]byte{}, data[:42]...)
+	out[4] &= 0x7f
+	pos := 42
+	for data[pos]&0x80 == 0 {
+		pos += 4 + int(binary.BigEndian.Uint32(data[pos:pos+4])&0xFFFFFF)
+	}
+	audio := data[pos+4+int(binary.BigEndian.Uint32(data[pos:pos+4])&0xFFFFFF):]
+	for i, typ := range order {
+		hdr := make([]byte, 4)
+		binary.BigEndian.PutUint32(hdr, uint32(len(blocks[typ])))
+		hdr[0] = typ
+		if i == len(order)-1 {
+			hdr[0] |= 0x80
+		}
+		out = append(out, hdr...)
+		out = append(out, blocks[typ]...)
+	}
+	return append(out, audio...)
+}
+
+// oggPage Build an ogg page holding a single packet or the end of a packet.
+func oggPage(serial, seq uint32, granule uint64, headerType byte, packet []byte) []byte {
+	return buildOggPage(serial, seq, granule, headerType, packet, true)
+}
+
+// oggOpenPage Build an ogg page holding the start of a packet continued on
+// the next page. The fragment length must be a multiple of 255.
+func oggOpenPage(serial, seq uint32, headerType byte, fragment []byte) []byte {
+	return buildOggPage(serial, seq, 0xFFFFFFFFFFFFFFFF, headerType, fragment, false)
+}
+
+// buildOggPage Build an ogg page with its checksum, computed bit by bit so
+// it doesn't depend on the table of the package.
+func buildOggPage(serial, seq uint32, granule uint64, headerType byte, packet []byte, terminated bool) []byte {
+	page := []byte("OggS\x00")
+	page = append(page, headerType)
+	page = binary.LittleEndian.AppendUint64(page, granule)
+	page = binary.LittleEndian.AppendUint32(page, serial)
+	page = binary.LittleEndian.AppendUint32(page, seq)
+	page = append(page, 0, 0, 0, 0)
+	segs := []byte{}
+	n := len(packet)
+	for n >= 255 {
+		segs = append(segs, 255)
+		n -= 255
+	}
+	if terminated {
+		segs = append(segs, byte(n))
+	}
+	page = append(page, byte(len(segs)))
+	page = append(page, segs...)
+	page = append(page, packet...)
+
+	var crc uint32
+	for _, b := range page {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(page[22:26], crc)
+	return page
+}
+
+// mp4Box Build a mp4 box from the concatenated content.
+func mp4Box(typ string, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	box = append(box, typ...)
+	return append(box, body...)
+}
+
+// mp4Trak Build a trak box with tkhd, mdhd and hdlr.
+func mp4Trak(id, flags uint32, handler, lang string, timeScale, duration uint32) []byte {
+	code := uint32(lang[0]-0x60)<<10 | uint32(lang[1]-0x60)<<5 | uint32(lang[2]-0x60)
+	return mp4Box("trak",
+		mp4Box("tkhd", u32s(flags, 0, 0, id, 0, 0), make([]byte, 60)),
+		mp4Box("mdia",
+			mp4Box("mdhd", u32s(0, 0, 0, timeScale, duration, code<<16)),
+			mp4Box("hdlr", u32s(0, 0), []byte(handler), make([]byte, 13))))
+}
@@ -0,0 +1,111 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+)
+
+// parseID3v2Text Parse the text frames of an ID3v2.2/2.3/2.4 tag. The result
+// maps frame IDs (e.g. TIT2, TPE1) to their text; multiple values are joined
+// with "/".
+// https://id3.org/id3v2.4.0-structure
+func parseID3v2Text(tag []byte) (map[string]string, error) {
+	if len(tag) < 10 || string(tag[0:3]) != "ID3" {
+		return nil, errors.New("not ID3v2 tag")
+	}
+	version := tag[3]
+	flags := tag[5]
+	size := int(parseID3v2Length(tag))
+	if flags&0x10 != 0 {
+		// parseID3v2Length counts the footer
+		size -= 10
+	}
+	if 10+size < len(tag) {
+		tag = tag[:10+size]
+	}
+	pos := 10
+	// Skip the extended header
+	if flags&0x40 != 0 && version >= 3 && len(tag) >= pos+4 {
+		extSize := int(binary.BigEndian.Uint32(tag[pos : pos+4]))
+		if version == 4 {
+			extSize = int(parseSynchsafe(tag[pos : pos+4]))
+		} else {
+			extSize += 4
+		}
+		pos += extSize
+	}
+
+	idLen, hdrLen := 4, 10
+	if version == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	frames := map[string]string{}
+	for pos+hdrLen <= len(tag) {
+		id := string(tag[pos : pos+idLen])
+		if tag[pos] == 0 {
+			// padding
+			break
+		}
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(tag[pos+3])<<16 | int(tag[pos+4])<<8 | int(tag[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[pos+4 : pos+8]))
+		default:
+			frameSize = int(parseSynchsafe(tag[pos+4 : pos+8]))
+		}
+		pos += hdrLen
+		if frameSize < 0 || frameSize > len(tag)-pos {
+			break
+		}
+		content := tag[pos : pos+frameSize]
+		pos += frameSize
+		if id[0] == 'T' && id != "TXXX" && id != "TXX" && len(content) > 0 {
+			frames[id] = decodeID3v2Text(content[0], content[1:])
+		}
+	}
+	return frames, nil
+}
+
+func parseSynchsafe(b []byte) uint32 {
+	var v uint32 = 0
+	for _, c := range b {
+		v = v<<7 | uint32(c&0x7F)
+	}
+	return v
+}
+
+// decodeID3v2Text Decode a text frame content by its encoding byte.
+func decodeID3v2Text(encoding byte, b []byte) string {
+	var s string
+	switch encoding {
+	case 0: // ISO-8859-1
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		s = string(runes)
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		var units []uint16
+		for i := 0; i+1 < len(b); i += 2 {
+			if encoding == 1 && (b[i] == 0xFF && b[i+1] == 0xFE || b[i] == 0xFE && b[i+1] == 0xFF) {
+				bigEndian = b[i] == 0xFE
+				continue
+			}
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(b[i:i+2]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(b[i:i+2]))
+			}
+		}
+		s = string(utf16.Decode(units))
+	default: // UTF-8
+		s = string(b)
+	}
+	s = strings.TrimRight(s, "\x00")
+	return strings.ReplaceAll(s, "\x00", "/")
+}
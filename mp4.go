@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"io"
+	"strconv"
+	"strings"
 )
 
 // The specification of MP4 file could be get here.
@@ -16,34 +18,177 @@ import (
 // which structure is difined at:
 // https://developer.apple.com/library/archive/documentation/QuickTime/QTFF/QTFFChap2/qtff2.html#//apple_ref/doc/uid/TP40000939-CH204-SW34
 
+// Fragmented MP4 (ISO/IEC 14496-12 movie fragments) stores an empty sample
+// table in moov and the samples in moof boxes. The duration is then read
+// from moov.mvex.mehd or summed from moof.traf.trun sample durations.
+
+// mp4MaxBoxSize Limit of boxes read into memory.
+const mp4MaxBoxSize = 64 << 20
+
+// Mp4Track Properties of a track collected from its trak box.
+type Mp4Track struct {
+	ID            uint32
+	Handler       string  // handler type of hdlr, e.g. soun, vide, text
+	Enabled       bool    // track enabled flag of tkhd
+	Language      string  // ISO 639-2/T code of mdhd, e.g. eng, und
+	TimeScale     uint64  // media timescale of mdhd
+	MediaDuration float64 // duration of all samples, from stts or mdhd
+	Priming       uint64  // samples skipped at the start, from elst or iTunSMPB
+	Padding       uint64  // samples dropped at the end, from elst or iTunSMPB
+	Duration      float64 // presentation duration after the edit list
+
+	SampleEntry     string // sample entry type of stsd, e.g. mp4a, alac, avc1
+	Codec           string // e.g. AAC-LC, HE-AAC, ALAC, Opus, FLAC, AC-3, E-AC-3, MP3
+	ObjectType      uint8  // object type indication of esds, 0x40 for MPEG-4 audio
+	AudioObjectType uint8  // MPEG-4 audio object type, 2 for AAC-LC, 5 for HE-AAC
+	SampleRate      uint32
+	Channels        uint16
+	BitsPerSample   uint16
+
+	mediaUnits  uint64 // duration of all samples in timescale units
+	edits       []mp4Edit
+	chapterRefs []uint32          // track IDs of the tref chap reference
+	sampleBoxes map[string][]byte // sample table boxes of text tracks
+}
+
+// mp4Edit An edit list entry. Empty edits have a media time of -1.
+type mp4Edit struct {
+	duration  uint64 // in movie timescale units
+	mediaTime int64  // in media timescale units
+	rate      uint16 // integer part of the media rate
+}
+
+// IsAudio Report whether the track is a sound track.
+func (t Mp4Track) IsAudio() bool {
+	return t.Handler == "soun"
+}
+
+// isText Report whether the track is a text track, which may hold chapters.
+func (t Mp4Track) isText() bool {
+	return t.Handler == "text" || t.Handler == "sbtl"
+}
+
+// Mp4Info Properties of a mp4 file and all its tracks.
+type Mp4Info struct {
+	TimeScale  uint64 // movie timescale of mvhd
+	Fragmented bool   // the samples are stored in movie fragments
+	Tracks     []Mp4Track
+	Duration   float64 // duration of the first enabled audio track
+
+	// Metadata The iTunes and QuickTime user data of moov, nil if missing.
+	Metadata *Mp4Metadata
+	// Chapters From a QuickTime chapter track or a Nero chpl box.
+	Chapters []Mp4Chapter
+}
+
+// FirstAudioTrack Return the first enabled audio track, or the first audio
+// track when all of them are disabled.
+func (info Mp4Info) FirstAudioTrack() (Mp4Track, bool) {
+	var first Mp4Track
+	found := false
+	for _, t := range info.Tracks {
+		if !t.IsAudio() {
+			continue
+		}
+		if t.Enabled {
+			return t, true
+		}
+		if !found {
+			first = t
+			found = true
+		}
+	}
+	return first, found
+}
+
+// LongestAudioTrack Return the audio track with the longest duration.
+func (info Mp4Info) LongestAudioTrack() (Mp4Track, bool) {
+	var longest Mp4Track
+	found := false
+	for _, t := range info.Tracks {
+		if t.IsAudio() && (!found || t.Duration > longest.Duration) {
+			longest = t
+			found = true
+		}
+	}
+	return longest, found
+}
+
+// AudioTrackByLanguage Return the first audio track in the language, an
+// enabled one being preferred.
+func (info Mp4Info) AudioTrackByLanguage(lang string) (Mp4Track, bool) {
+	var tracks []Mp4Track
+	for _, t := range info.Tracks {
+		if t.IsAudio() && t.Language == lang {
+			tracks = append(tracks, t)
+		}
+	}
+	return Mp4Info{Tracks: tracks}.FirstAudioTrack()
+}
+
+// mp4Fragments Sample time ranges of movie fragments by track ID, in media
+// timescale units.
+type mp4Fragments struct {
+	defaultDuration map[uint32]uint32 // default sample duration from trex
+	start           map[uint32]uint64
+	end             map[uint32]uint64
+}
+
 // Mp4 Calculate mp4 files duration.
 func Mp4(r io.ReadSeeker) (float64, error) {
-	for {
+	info, err := parseMp4(r, false)
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
+}
+
+// ParseMp4 Parse the tracks of a mp4 file. The duration of fragmented files
+// is read from mvex or summed from the moof boxes.
+func ParseMp4(r io.ReadSeeker) (Mp4Info, error) {
+	return parseMp4(r, true)
+}
+
+// parseMp4 Parse a mp4 file, reading the chapters only when withChapters
+// is set.
+func parseMp4(r io.ReadSeeker, withChapters bool) (Mp4Info, error) {
+	var info Mp4Info
+	var hasMoov bool = false
+	var fragmentDuration uint64 = 0
+	var neroChapters []Mp4Chapter
+	frags := mp4Fragments{
+		defaultDuration: map[uint32]uint32{},
+		start:           map[uint32]uint64{},
+		end:             map[uint32]uint64{},
+	}
+
+	// fragments are only walked when mehd is absent
+	for !hasMoov || (info.Fragmented && fragmentDuration == 0) {
 		typ, size, headerLen, err := readAtomHeader(r)
 		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
-			return 0, err
+			return info, err
 		}
 		if size < headerLen {
-			return 0, errors.New("invalid MP4 atom size")
+			return info, errors.New("invalid MP4 atom size")
 		}
 		content := int64(size - headerLen)
 
 		switch typ {
 		case "moov":
+			hasMoov = true
 			tmp, _ := r.Seek(0, io.SeekCurrent)
 			moovEnd := tmp + content
-			var movieTimeScale uint64 = 0
 
 			for {
 				childTyp, childSize, childHdrLen, err := readAtomHeader(r)
 				if err != nil {
-					return 0, err
+					return info, err
 				}
 				if childSize < childHdrLen {
-					return 0, errors.New("invalid MP4 child atom size")
+					return info, errors.New("invalid MP4 child atom size")
 				}
 				// compute end of this child box to realign after parsing its content
 				tmp, _ = r.Seek(0, io.SeekCurrent)
@@ -54,28 +199,39 @@ func Mp4(r io.ReadSeeker) (float64, error) {
 					// We only use mvhd to get movie timescale for elst conversion
 					ts, _, err := parseMvhd(r)
 					if err != nil {
-						return 0, err
+						return info, err
 					}
-					movieTimeScale = ts
+					info.TimeScale = ts
 					// seek to end of mvhd box
 					if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
-						return 0, err
+						return info, err
 					}
 				case "trak":
-					if d, ok, err := readAudioDurationInTrak(r, childEnd, movieTimeScale); err != nil {
-						return 0, err
-					} else if ok {
-						return d, nil
-					} else {
-						// ensure aligned at end of trak
-						if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
-							return 0, err
-						}
+					t, err := readTrak(r, childEnd)
+					if err != nil {
+						return info, err
 					}
+					info.Tracks = append(info.Tracks, t)
+				case "udta":
+					// malformed metadata does not affect the duration
+					if meta, chapters, err := readUdta(r, childEnd); err == nil {
+						info.Metadata = meta
+						neroChapters = chapters
+					}
+					if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
+						return info, err
+					}
+				case "mvex":
+					info.Fragmented = true
+					fd, err := readMvex(r, childEnd, &frags)
+					if err != nil {
+						return info, err
+					}
+					fragmentDuration = fd
 				default:
 					// skip unknown child box
 					if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
-						return 0, err
+						return info, err
 					}
 				}
 
@@ -83,21 +239,154 @@ func Mp4(r io.ReadSeeker) (float64, error) {
 					break
 				}
 			}
+		case "moof":
+			tmp, _ := r.Seek(0, io.SeekCurrent)
+			if err := readMoof(r, tmp+content, &frags); err != nil {
+				return info, err
+			}
 		default:
 			if err := skip(r, content); err != nil {
-				return 0, err
+				return info, err
 			}
 		}
 	}
 
-	return 0, errors.New("audio mdhd not found")
+	for i := range info.Tracks {
+		t := &info.Tracks[i]
+		if info.Fragmented && t.mediaUnits == 0 {
+			if fragmentDuration > 0 && info.TimeScale != 0 {
+				t.mediaUnits = fragmentDuration * t.TimeScale / info.TimeScale
+			} else if end, ok := frags.end[t.ID]; ok {
+				t.mediaUnits = end - frags.start[t.ID]
+			}
+		}
+		t.applyEdits(info.TimeScale)
+	}
+
+	audio, ok := info.FirstAudioTrack()
+	if !ok {
+		return info, errors.New("audio mdhd not found")
+	}
+	if smpb := info.Metadata.freeform("iTunSMPB"); smpb != "" && audio.Priming == 0 && audio.Padding == 0 {
+		if priming, padding, ok := parseITunSMPB(smpb); ok && priming+padding < audio.mediaUnits {
+			for i := range info.Tracks {
+				t := &info.Tracks[i]
+				if t.ID == audio.ID {
+					t.Priming = priming
+					t.Padding = padding
+					t.Duration = float64(t.mediaUnits-priming-padding) / float64(t.TimeScale)
+					audio = *t
+				}
+			}
+		}
+	}
+	info.Duration = audio.Duration
+	if withChapters {
+		info.Chapters = readMp4Chapters(r, info, audio, neroChapters)
+	}
+	return info, nil
 }
 
-func readAudioDurationInTrak(r io.ReadSeeker, endPos int64, movieTS uint64) (float64, bool, error) {
-	var dur float64 = 0
-	var elstSecs float64 = 0
-	var haveMdhd bool = false
-	var haveElst bool = false
+// readMp4Chapters Read the chapters of the text track referenced by the
+// audio track, or of any track, falling back to the Nero chapters.
+// Unreadable chapter tracks are ignored.
+func readMp4Chapters(r io.ReadSeeker, info Mp4Info, audio Mp4Track, nero []Mp4Chapter) []Mp4Chapter {
+	refs := audio.chapterRefs
+	for _, t := range info.Tracks {
+		if len(refs) > 0 {
+			break
+		}
+		refs = t.chapterRefs
+	}
+	for _, id := range refs {
+		for _, t := range info.Tracks {
+			if t.ID != id || !t.isText() {
+				continue
+			}
+			if chapters, err := readChapterTrack(r, t); err == nil && len(chapters) > 0 {
+				return chapters
+			}
+		}
+	}
+	setChapterEnd(nero, info.Duration)
+	return nero
+}
+
+// applyEdits Compute the presentation duration of the track from its media
+// duration and edit list. Empty edits add their duration; other edits
+// present the media from their media time, limited to the samples
+// available.
+func (t *Mp4Track) applyEdits(movieTS uint64) {
+	if t.TimeScale == 0 {
+		return
+	}
+	t.MediaDuration = float64(t.mediaUnits) / float64(t.TimeScale)
+	t.Duration = t.MediaDuration
+	if len(t.edits) == 0 {
+		return
+	}
+
+	var total float64 = 0
+	var presented uint64 = 0
+	first := true
+	for _, e := range t.edits {
+		if e.mediaTime < 0 {
+			if movieTS != 0 {
+				total += float64(e.duration) / float64(movieTS)
+			}
+			continue
+		}
+		// Only normal rate 1.0 is counted
+		if e.rate != 1 {
+			continue
+		}
+		var available uint64 = 0
+		if uint64(e.mediaTime) < t.mediaUnits {
+			available = t.mediaUnits - uint64(e.mediaTime)
+		}
+		units := available
+		// a zero duration edit extends to the end of the media, as in
+		// fragmented files
+		if e.duration > 0 && movieTS != 0 {
+			if u := e.duration * t.TimeScale / movieTS; u < available {
+				units = u
+			}
+		}
+		if first {
+			t.Priming = uint64(e.mediaTime)
+			first = false
+		}
+		presented = uint64(e.mediaTime) + units
+		total += float64(units) / float64(t.TimeScale)
+	}
+	if !first && presented < t.mediaUnits {
+		t.Padding = t.mediaUnits - presented
+	}
+	t.Duration = total
+}
+
+// parseITunSMPB Read the priming and padding samples of an iTunSMPB value
+// " 00000000 00000840 000001CA 00000000003F31F6 ...".
+func parseITunSMPB(s string) (uint64, uint64, bool) {
+	fields := strings.Fields(s)
+	if len(fields) < 3 {
+		return 0, 0, false
+	}
+	priming, err := strconv.ParseUint(fields[1], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	padding, err := strconv.ParseUint(fields[2], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return priming, padding, true
+}
+
+// readTrak Read the properties of a track. The edit list is applied once
+// the movie timescale and the fragments are known.
+func readTrak(r io.ReadSeeker, endPos int64) (Mp4Track, error) {
+	track := Mp4Track{sampleBoxes: map[string][]byte{}}
 
 	for {
 		typ, size, headerLen, err := readAtomHeader(r)
@@ -105,43 +394,45 @@ func readAudioDurationInTrak(r io.ReadSeeker, endPos int64, movieTS uint64) (flo
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				break
 			}
-			return 0, false, err
+			return track, err
 		}
 		if size < headerLen {
-			return 0, false, errors.New("invalid MP4 atom size in trak")
+			return track, errors.New("invalid MP4 atom size in trak")
 		}
 		content := int64(size - headerLen)
 		tmp, _ := r.Seek(0, io.SeekCurrent)
 		childEnd := tmp + content
 
 		switch typ {
-		case "mdia":
-			isAudio, mts, md, ok, err := readMdiaInfo(r, childEnd)
+		case "tkhd":
+			id, enabled, err := parseTkhd(r)
 			if err != nil {
-				return 0, false, err
+				return track, err
 			}
-			if ok && isAudio {
-				if mts != 0 {
-					haveMdhd = true
-					dur = float64(md) / float64(mts)
-				}
+			track.ID = id
+			track.Enabled = enabled
+			if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
+				return track, err
+			}
+		case "mdia":
+			if err := readMdiaInfo(r, childEnd, &track); err != nil {
+				return track, err
 			}
+		case "tref":
+			buf, err := readMp4BoxContent(r, content)
+			if err != nil {
+				return track, err
+			}
+			track.chapterRefs = parseTref(buf)
 		case "edts":
-			if movieTS != 0 {
-				if secs, ok, err := readElstSeconds(r, childEnd, movieTS); err != nil {
-					return 0, false, err
-				} else if ok {
-					haveElst = true
-					elstSecs = secs
-				}
-			} else {
-				if err := skip(r, content); err != nil {
-					return 0, false, err
-				}
+			edits, err := readElst(r, childEnd)
+			if err != nil {
+				return track, err
 			}
+			track.edits = edits
 		default:
 			if err := skip(r, content); err != nil {
-				return 0, false, err
+				return track, err
 			}
 		}
 
@@ -150,204 +441,431 @@ func readAudioDurationInTrak(r io.ReadSeeker, endPos int64, movieTS uint64) (flo
 		}
 	}
 
-	if haveElst && elstSecs > 0 {
-		return elstSecs, true, nil
+	if _, err := r.Seek(endPos, io.SeekStart); err != nil {
+		return track, err
 	}
-	if haveMdhd {
-		return dur, true, nil
+	return track, nil
+}
+
+// parseTkhd Read the track ID and the enabled flag of a tkhd box.
+func parseTkhd(r io.ReadSeeker) (uint32, bool, error) {
+	b4 := make([]byte, 4)
+	if _, err := io.ReadFull(r, b4); err != nil {
+		return 0, false, err
 	}
-	if _, err := r.Seek(endPos, io.SeekStart); err != nil {
+	enabled := b4[3]&0x01 != 0
+	if b4[0] == 1 {
+		// creation(8) + modification(8)
+		if err := skip(r, 16); err != nil {
+			return 0, false, err
+		}
+	} else {
+		// creation(4) + modification(4)
+		if err := skip(r, 8); err != nil {
+			return 0, false, err
+		}
+	}
+	if _, err := io.ReadFull(r, b4); err != nil {
 		return 0, false, err
 	}
-	return 0, false, nil
+	return binary.BigEndian.Uint32(b4), enabled, nil
 }
 
-func readMdiaInfo(r io.ReadSeeker, endPos int64) (isAudio bool, ts uint64, dur uint64, hasMdhd bool, err error) {
-	isAudio = false
-	hasMdhd = false
-	ts = 0
-	dur = 0
-
+// readMvex Read the fragment duration of mehd, in movie timescale, and the
+// default sample durations of trex boxes.
+func readMvex(r io.ReadSeeker, endPos int64, frags *mp4Fragments) (uint64, error) {
+	var fragmentDuration uint64 = 0
 	for {
-		typ, size, headerLen, e := readAtomHeader(r)
-		if e != nil {
-			if e == io.EOF || e == io.ErrUnexpectedEOF {
-				break
-			}
-			err = e
-			return
+		cur, _ := r.Seek(0, io.SeekCurrent)
+		if cur+8 > endPos {
+			break
+		}
+		typ, size, headerLen, err := readAtomHeader(r)
+		if err != nil {
+			return 0, err
 		}
 		if size < headerLen {
-			err = errors.New("invalid MP4 atom size in mdia")
-			return
+			return 0, errors.New("invalid MP4 atom size in mvex")
 		}
-		content := int64(size - headerLen)
-		tmp, _ := r.Seek(0, io.SeekCurrent)
-		childEnd := tmp + content
+		childEnd := cur + int64(size)
 
 		switch typ {
-		case "hdlr":
-			if content < 12 {
-				err = errors.New("invalid MP4 atom size in mdia hdlr")
-				return
-			}
+		case "mehd":
 			buf := make([]byte, 12)
-			if _, e := io.ReadFull(r, buf); e != nil {
-				err = e
-				return
-			}
-			handler := string(buf[8:12])
-			if handler == "soun" {
-				isAudio = true
-			}
-			if e := skip(r, content-12); e != nil {
-				err = e
-				return
-			}
-		case "mdhd":
-			vbuf := make([]byte, 4)
-			if _, e := io.ReadFull(r, vbuf); e != nil {
-				err = e
-				return
+			if _, err := io.ReadFull(r, buf[0:8]); err != nil {
+				return 0, err
 			}
-			version := vbuf[0]
-			if version == 1 {
-				// creation(8) + modification(8)
-				if e := skip(r, 16); e != nil {
-					err = e
-					return
-				}
-				b4 := make([]byte, 4)
-				if _, e := io.ReadFull(r, b4); e != nil {
-					err = e
-					return
-				}
-				ts = uint64(binary.BigEndian.Uint32(b4))
-				b8 := make([]byte, 8)
-				if _, e := io.ReadFull(r, b8); e != nil {
-					err = e
-					return
+			if buf[0] == 1 {
+				if _, err := io.ReadFull(r, buf[8:12]); err != nil {
+					return 0, err
 				}
-				dur = binary.BigEndian.Uint64(b8)
+				fragmentDuration = binary.BigEndian.Uint64(buf[4:12])
 			} else {
-				// version 0: creation(4) + modification(4)
-				if e := skip(r, 8); e != nil {
-					err = e
-					return
-				}
-				b4 := make([]byte, 4)
-				if _, e := io.ReadFull(r, b4); e != nil {
-					err = e
-					return
-				}
-				ts = uint64(binary.BigEndian.Uint32(b4))
-				if _, e := io.ReadFull(r, b4); e != nil {
-					err = e
-					return
-				}
-				dur = uint64(binary.BigEndian.Uint32(b4))
-			}
-
-			if _, e := r.Seek(childEnd, io.SeekStart); e != nil {
-				err = e
-				return
+				fragmentDuration = uint64(binary.BigEndian.Uint32(buf[4:8]))
 			}
-			hasMdhd = true
-		default:
-			if e := skip(r, content); e != nil {
-				err = e
-				return
+		case "trex":
+			// version/flags(4), track_ID(4), default_sample_description_index(4),
+			// default_sample_duration(4)
+			buf := make([]byte, 16)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return 0, err
 			}
+			frags.defaultDuration[binary.BigEndian.Uint32(buf[4:8])] = binary.BigEndian.Uint32(buf[12:16])
+		}
+		if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
+			return 0, err
 		}
+	}
+	if _, err := r.Seek(endPos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return fragmentDuration, nil
+}
 
-		if childEnd >= endPos {
+// readMoof Add the sample durations of each traf in a moof box to the time
+// range of its track. A traf starts at its tfdt decode time when present,
+// otherwise right after the previous fragment of the track.
+func readMoof(r io.ReadSeeker, endPos int64, frags *mp4Fragments) error {
+	for {
+		cur, _ := r.Seek(0, io.SeekCurrent)
+		if cur+8 > endPos {
 			break
 		}
+		typ, size, headerLen, err := readAtomHeader(r)
+		if err != nil {
+			return err
+		}
+		if size < headerLen {
+			return errors.New("invalid MP4 atom size in moof")
+		}
+		childEnd := cur + int64(size)
+		if typ == "traf" {
+			if err := readTraf(r, childEnd, frags); err != nil {
+				return err
+			}
+		}
+		if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
+			return err
+		}
 	}
-	return
+	_, err := r.Seek(endPos, io.SeekStart)
+	return err
 }
 
-func readElstSeconds(r io.ReadSeeker, endPos int64, movieTS uint64) (float64, bool, error) {
+func readTraf(r io.ReadSeeker, endPos int64, frags *mp4Fragments) error {
+	var trackID uint32 = 0
+	var defaultDuration uint32 = 0
+	var decodeTime uint64 = 0
+	var hasDecodeTime bool = false
+	var total uint64 = 0
+
 	for {
+		cur, _ := r.Seek(0, io.SeekCurrent)
+		if cur+8 > endPos {
+			break
+		}
 		typ, size, headerLen, err := readAtomHeader(r)
 		if err != nil {
-			return 0, false, err
+			return err
 		}
 		if size < headerLen {
-			err = errors.New("invalid MP4 atom size in edts")
-			return 0, false, err
+			return errors.New("invalid MP4 atom size in traf")
+		}
+		childEnd := cur + int64(size)
+		body := int64(size - headerLen)
+		// other children, e.g. sdtp or sbgp, are skipped whatever their size
+		if (typ == "tfhd" || typ == "trun" || typ == "tfdt") && (body < 8 || body > mp4MaxBoxSize) {
+			return errors.New("invalid MP4 atom size in traf")
 		}
-		content := int64(size - headerLen)
-		tmp, _ := r.Seek(0, io.SeekCurrent)
-		childEnd := tmp + content
 
 		switch typ {
-		case "elst":
-			b4 := make([]byte, 4)
-			if _, err := io.ReadFull(r, b4); err != nil {
-				return 0, false, err
+		case "tfhd":
+			buf := make([]byte, body)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
 			}
-			version := b4[0]
-
-			if _, err := io.ReadFull(r, b4); err != nil {
-				return 0, false, err
+			flags := binary.BigEndian.Uint32(buf[0:4]) & 0xFFFFFF
+			trackID = binary.BigEndian.Uint32(buf[4:8])
+			defaultDuration = frags.defaultDuration[trackID]
+			pos := 8
+			if flags&0x01 != 0 {
+				// base_data_offset
+				pos += 8
 			}
-			entryCount := binary.BigEndian.Uint32(b4)
-
-			var totalDur uint64 = 0
-
-			for i := uint32(0); i < entryCount; i++ {
-				var segDur uint64 = 0
-				if version == 1 {
-					b8 := make([]byte, 8)
-					if _, err := io.ReadFull(r, b8); err != nil {
-						return 0, false, err
-					}
-					segDur = binary.BigEndian.Uint64(b8)
-					// media_time(8)
-					if _, err := io.ReadFull(r, b8); err != nil {
-						return 0, false, err
-					}
-				} else {
-					if _, err := io.ReadFull(r, b4); err != nil {
-						return 0, false, err
-					}
-					segDur = uint64(binary.BigEndian.Uint32(b4))
-					// media_time(4)
-					if _, err := io.ReadFull(r, b4); err != nil {
-						return 0, false, err
-					}
-				}
-				// media_rate_integer(2)+fraction(2)
-				if _, err := io.ReadFull(r, b4); err != nil {
-					return 0, false, err
+			if flags&0x02 != 0 {
+				// sample_description_index
+				pos += 4
+			}
+			if flags&0x08 != 0 && len(buf) >= pos+4 {
+				defaultDuration = binary.BigEndian.Uint32(buf[pos : pos+4])
+			}
+		case "tfdt":
+			buf := make([]byte, 12)
+			if _, err := io.ReadFull(r, buf[0:8]); err != nil {
+				return err
+			}
+			if buf[0] == 1 {
+				if _, err := io.ReadFull(r, buf[8:12]); err != nil {
+					return err
 				}
-				// Only normal rate 1.0 is counted
-				if binary.BigEndian.Uint16(b4[0:2]) == 1 {
-					totalDur += segDur
+				decodeTime = binary.BigEndian.Uint64(buf[4:12])
+			} else {
+				decodeTime = uint64(binary.BigEndian.Uint32(buf[4:8]))
+			}
+			hasDecodeTime = true
+		case "trun":
+			buf := make([]byte, body)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			flags := binary.BigEndian.Uint32(buf[0:4]) & 0xFFFFFF
+			count := binary.BigEndian.Uint32(buf[4:8])
+			pos := 8
+			if flags&0x01 != 0 {
+				// data_offset
+				pos += 4
+			}
+			if flags&0x04 != 0 {
+				// first_sample_flags
+				pos += 4
+			}
+			if flags&0x100 == 0 {
+				total += uint64(count) * uint64(defaultDuration)
+				break
+			}
+			// per sample: duration, size, flags, composition time offset
+			stride := 4
+			for _, f := range []uint32{0x200, 0x400, 0x800} {
+				if flags&f != 0 {
+					stride += 4
 				}
 			}
-
-			// skip remainder
-			if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
-				return 0, false, err
+			for i := uint32(0); i < count && pos+4 <= len(buf); i++ {
+				total += uint64(binary.BigEndian.Uint32(buf[pos : pos+4]))
+				pos += stride
 			}
+		}
+		if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
+			return err
+		}
+	}
 
-			if totalDur > 0 {
-				return float64(totalDur) / float64(movieTS), true, nil
+	start, seen := frags.end[trackID]
+	if hasDecodeTime {
+		start = decodeTime
+	}
+	if !seen || start < frags.start[trackID] {
+		frags.start[trackID] = start
+	}
+	if end := start + total; !seen || end > frags.end[trackID] {
+		frags.end[trackID] = end
+	}
+	return nil
+}
+
+// readMdiaInfo Read the handler, timescale, language, codec and media
+// duration of a track. The duration of the stts sample deltas is
+// preferred over the mdhd duration.
+func readMdiaInfo(r io.ReadSeeker, endPos int64, track *Mp4Track) error {
+	var mdhdDuration uint64 = 0
+	var sttsDuration uint64 = 0
+
+	err := walkMp4Boxes(r, endPos, func(typ string, content int64, end int64) error {
+		switch typ {
+		case "hdlr":
+			if content < 12 {
+				return errors.New("invalid MP4 atom size in mdia hdlr")
 			}
-			return 0, false, nil
-		default:
-			if err = skip(r, content); err != nil {
-				return 0, false, err
+			buf := make([]byte, 12)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			track.Handler = string(buf[8:12])
+		case "mdhd":
+			vbuf := make([]byte, 4)
+			if _, err := io.ReadFull(r, vbuf); err != nil {
+				return err
 			}
+			version := vbuf[0]
+			if version == 1 {
+				// creation(8) + modification(8), timescale(4), duration(8)
+				buf := make([]byte, 28)
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return err
+				}
+				track.TimeScale = uint64(binary.BigEndian.Uint32(buf[16:20]))
+				mdhdDuration = binary.BigEndian.Uint64(buf[20:28])
+			} else {
+				// version 0: creation(4) + modification(4), timescale(4), duration(4)
+				buf := make([]byte, 16)
+				if _, err := io.ReadFull(r, buf); err != nil {
+					return err
+				}
+				track.TimeScale = uint64(binary.BigEndian.Uint32(buf[8:12]))
+				mdhdDuration = uint64(binary.BigEndian.Uint32(buf[12:16]))
+			}
+			// language: pad(1) + three 5 bit characters offset by 0x60
+			b2 := make([]byte, 2)
+			if _, err := io.ReadFull(r, b2); err == nil {
+				track.Language = parseMp4Language(binary.BigEndian.Uint16(b2))
+			}
+		case "minf":
+			return walkMp4Boxes(r, end, func(typ string, content int64, end int64) error {
+				if typ != "stbl" {
+					return nil
+				}
+				return walkMp4Boxes(r, end, func(typ string, content int64, end int64) error {
+					switch typ {
+					case "stsd":
+						return readStsd(r, content, track)
+					case "stts":
+						d, buf, err := readStts(r, content)
+						if err != nil {
+							return err
+						}
+						sttsDuration = d
+						if track.isText() {
+							track.sampleBoxes[typ] = buf
+						}
+					case "stsz", "stsc", "stco", "co64":
+						// sample locations of chapter titles
+						if !track.isText() {
+							return nil
+						}
+						buf, err := readMp4BoxContent(r, content)
+						if err != nil {
+							return err
+						}
+						track.sampleBoxes[typ] = buf
+					}
+					return nil
+				})
+			})
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		if childEnd >= endPos {
+	track.mediaUnits = mdhdDuration
+	if sttsDuration > 0 {
+		track.mediaUnits = sttsDuration
+	}
+	return nil
+}
+
+// readStts Sum the sample deltas of a stts box, in media timescale units.
+// The box content is returned for the sample table of chapter tracks.
+func readStts(r io.Reader, content int64) (uint64, []byte, error) {
+	buf, err := readMp4BoxContent(r, content)
+	if err != nil {
+		return 0, nil, err
+	}
+	// version/flags(4), entry_count(4), entries of sample_count(4) + sample_delta(4)
+	count := int(binary.BigEndian.Uint32(buf[4:8]))
+	var total uint64 = 0
+	for i, pos := 0, 8; i < count && pos+8 <= len(buf); i, pos = i+1, pos+8 {
+		total += uint64(binary.BigEndian.Uint32(buf[pos:pos+4])) * uint64(binary.BigEndian.Uint32(buf[pos+4:pos+8]))
+	}
+	return total, buf, nil
+}
+
+// readMp4BoxContent Read the content of a full box of at least 8 bytes.
+func readMp4BoxContent(r io.Reader, content int64) ([]byte, error) {
+	if content < 8 || content > mp4MaxBoxSize {
+		return nil, errors.New("invalid MP4 atom size")
+	}
+	buf := make([]byte, content)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// walkMp4Boxes Call fn for each child box from the current position to
+// endPos, with the content size and the end position of the child. The
+// reader is positioned at the end of each child after fn returns.
+func walkMp4Boxes(r io.ReadSeeker, endPos int64, fn func(typ string, content int64, end int64) error) error {
+	for {
+		cur, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if cur+8 > endPos {
 			break
 		}
+		typ, size, headerLen, err := readAtomHeader(r)
+		if err != nil {
+			return err
+		}
+		if size < headerLen || cur+int64(size) > endPos {
+			return errors.New("invalid MP4 atom size")
+		}
+		childEnd := cur + int64(size)
+		if err := fn(typ, int64(size-headerLen), childEnd); err != nil {
+			return err
+		}
+		if _, err := r.Seek(childEnd, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	_, err := r.Seek(endPos, io.SeekStart)
+	return err
+}
+
+// parseMp4Language Decode the packed ISO 639-2/T language code of mdhd.
+func parseMp4Language(code uint16) string {
+	if code == 0 || code == 0x7FFF {
+		return ""
 	}
-	return 0, false, nil
+	return string([]byte{
+		byte(code>>10&0x1F) + 0x60,
+		byte(code>>5&0x1F) + 0x60,
+		byte(code&0x1F) + 0x60,
+	})
+}
+
+// readElst Read the edit list entries of an edts box.
+func readElst(r io.ReadSeeker, endPos int64) ([]mp4Edit, error) {
+	var edits []mp4Edit
+	err := walkMp4Boxes(r, endPos, func(typ string, content int64, end int64) error {
+		if typ != "elst" {
+			return nil
+		}
+		if content < 8 || content > mp4MaxBoxSize {
+			return errors.New("invalid MP4 atom size in elst")
+		}
+		buf := make([]byte, content)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		version := buf[0]
+		entryCount := binary.BigEndian.Uint32(buf[4:8])
+		entrySize := 12
+		if version == 1 {
+			entrySize = 20
+		}
+		pos := 8
+		for i := uint32(0); i < entryCount && pos+entrySize <= len(buf); i++ {
+			var e mp4Edit
+			if version == 1 {
+				// segment_duration(8), media_time(8)
+				e.duration = binary.BigEndian.Uint64(buf[pos : pos+8])
+				e.mediaTime = int64(binary.BigEndian.Uint64(buf[pos+8 : pos+16]))
+			} else {
+				// segment_duration(4), media_time(4)
+				e.duration = uint64(binary.BigEndian.Uint32(buf[pos : pos+4]))
+				e.mediaTime = int64(int32(binary.BigEndian.Uint32(buf[pos+4 : pos+8])))
+			}
+			// media_rate_integer(2)+fraction(2)
+			e.rate = binary.BigEndian.Uint16(buf[pos+entrySize-4 : pos+entrySize-2])
+			edits = append(edits, e)
+			pos += entrySize
+		}
+		return nil
+	})
+	return edits, err
 }
 
 func parseMvhd(r io.ReadSeeker) (uint64, uint64, error) {
@@ -0,0 +1,221 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"unicode/utf16"
+)
+
+// Chapters are stored either in a Nero 'chpl' box of moov.udta, with start
+// times in 100 nanosecond units, or as a QuickTime text track referenced by
+// the 'chap' reference of another track's tref box. Each sample of the text
+// track is a chapter title, its sample duration the chapter duration.
+// https://developer.apple.com/library/archive/documentation/QuickTime/QTFF/QTFFChap2/qtff2.html#//apple_ref/doc/uid/TP40000939-CH204-25706
+
+// Mp4Chapter A chapter of a mp4 file, times in seconds.
+type Mp4Chapter struct {
+	Title    string
+	Start    float64
+	Duration float64
+}
+
+// mp4ChplTimeScale Time unit of Nero chapter start times.
+const mp4ChplTimeScale = 10000000
+
+// parseChpl Decode the chapters of a Nero chpl box. Durations run to the
+// next chapter, the last one is completed by setChapterEnd.
+func parseChpl(b []byte) []Mp4Chapter {
+	if len(b) < 5 {
+		return nil
+	}
+	// version(1), flags(3), reserved(4) for version 1, chapter count(1)
+	pos := 4
+	if b[0] == 1 {
+		pos += 4
+	}
+	if pos >= len(b) {
+		return nil
+	}
+	count := int(b[pos])
+	pos++
+	var chapters []Mp4Chapter
+	for i := 0; i < count && pos+9 <= len(b); i++ {
+		// start(8), title length(1), title
+		start := binary.BigEndian.Uint64(b[pos : pos+8])
+		titleLen := int(b[pos+8])
+		pos += 9
+		if pos+titleLen > len(b) {
+			break
+		}
+		chapters = append(chapters, Mp4Chapter{
+			Title: string(b[pos : pos+titleLen]),
+			Start: float64(start) / mp4ChplTimeScale,
+		})
+		pos += titleLen
+	}
+	for i := 0; i+1 < len(chapters); i++ {
+		chapters[i].Duration = chapters[i+1].Start - chapters[i].Start
+	}
+	return chapters
+}
+
+// setChapterEnd Set the duration of the last chapter, ending at total.
+func setChapterEnd(chapters []Mp4Chapter, total float64) {
+	if n := len(chapters); n > 0 && total > chapters[n-1].Start {
+		chapters[n-1].Duration = total - chapters[n-1].Start
+	}
+}
+
+// parseTref Read the track IDs of the chap reference of a tref box.
+func parseTref(b []byte) []uint32 {
+	var ids []uint32
+	eachMp4Box(b, func(typ string, body []byte) {
+		if typ != "chap" {
+			return
+		}
+		for i := 0; i+4 <= len(body); i += 4 {
+			ids = append(ids, binary.BigEndian.Uint32(body[i:i+4]))
+		}
+	})
+	return ids
+}
+
+// mp4SampleLocations Compute the offset and size of each sample from the
+// stsz, stsc and stco (or co64) boxes of a sample table.
+func mp4SampleLocations(boxes map[string][]byte) ([]int64, []uint32, error) {
+	stsz, stsc := boxes["stsz"], boxes["stsc"]
+	if len(stsz) < 12 || len(stsc) < 8 {
+		return nil, nil, errors.New("incomplete chapter sample table")
+	}
+	// stsz: version/flags(4), sample_size(4), sample_count(4), entry sizes
+	sampleSize := binary.BigEndian.Uint32(stsz[4:8])
+	sampleCount := int(binary.BigEndian.Uint32(stsz[8:12]))
+	if sampleCount > mp4MaxBoxSize/4 || (sampleSize == 0 && 12+4*sampleCount > len(stsz)) {
+		return nil, nil, errors.New("invalid stsz")
+	}
+	sizes := make([]uint32, 0, sampleCount)
+	for i := 0; i < sampleCount; i++ {
+		if sampleSize != 0 {
+			sizes = append(sizes, sampleSize)
+		} else {
+			sizes = append(sizes, binary.BigEndian.Uint32(stsz[12+4*i:]))
+		}
+	}
+
+	// stco: version/flags(4), entry_count(4), 32 bit offsets; co64 has 64 bit
+	var chunks []int64
+	if stco := boxes["stco"]; len(stco) >= 8 {
+		n := int(binary.BigEndian.Uint32(stco[4:8]))
+		for i := 0; i < n && 8+4*i+4 <= len(stco); i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(stco[8+4*i:])))
+		}
+	} else if co64 := boxes["co64"]; len(co64) >= 8 {
+		n := int(binary.BigEndian.Uint32(co64[4:8]))
+		for i := 0; i < n && 8+8*i+8 <= len(co64); i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(co64[8+8*i:])))
+		}
+	}
+
+	// stsc: version/flags(4), entry_count(4), entries of first_chunk(4),
+	// samples_per_chunk(4), sample_description_index(4)
+	entries := int(binary.BigEndian.Uint32(stsc[4:8]))
+	offsets := make([]int64, 0, sampleCount)
+	for e := 0; e < entries && 8+12*e+12 <= len(stsc); e++ {
+		first := int(binary.BigEndian.Uint32(stsc[8+12*e:]))
+		perChunk := int(binary.BigEndian.Uint32(stsc[8+12*e+4:]))
+		last := len(chunks)
+		if e+1 < entries && 8+12*(e+1)+4 <= len(stsc) {
+			last = int(binary.BigEndian.Uint32(stsc[8+12*(e+1):])) - 1
+		}
+		for c := first; c <= last && c >= 1 && c <= len(chunks); c++ {
+			offset := chunks[c-1]
+			for s := 0; s < perChunk && len(offsets) < sampleCount; s++ {
+				offsets = append(offsets, offset)
+				offset += int64(sizes[len(offsets)-1])
+			}
+		}
+	}
+	if len(offsets) < sampleCount {
+		return nil, nil, errors.New("invalid chapter sample table")
+	}
+	return offsets, sizes, nil
+}
+
+// mp4SampleDeltas Expand the stts entries into one duration per sample.
+func mp4SampleDeltas(stts []byte) []uint32 {
+	var deltas []uint32
+	if len(stts) < 8 {
+		return deltas
+	}
+	count := int(binary.BigEndian.Uint32(stts[4:8]))
+	for i, pos := 0, 8; i < count && pos+8 <= len(stts); i, pos = i+1, pos+8 {
+		n := binary.BigEndian.Uint32(stts[pos : pos+4])
+		delta := binary.BigEndian.Uint32(stts[pos+4 : pos+8])
+		for j := uint32(0); j < n && len(deltas) < mp4MaxBoxSize/4; j++ {
+			deltas = append(deltas, delta)
+		}
+	}
+	return deltas
+}
+
+// readChapterTrack Read the chapters of a QuickTime text track, each sample
+// being a title of size(2) and text, UTF-8 or UTF-16 with a byte order mark.
+func readChapterTrack(r io.ReadSeeker, track Mp4Track) ([]Mp4Chapter, error) {
+	if track.TimeScale == 0 {
+		return nil, errors.New("invalid chapter track timescale")
+	}
+	offsets, sizes, err := mp4SampleLocations(track.sampleBoxes)
+	if err != nil {
+		return nil, err
+	}
+	deltas := mp4SampleDeltas(track.sampleBoxes["stts"])
+
+	var chapters []Mp4Chapter
+	var start uint64 = 0
+	for i := range offsets {
+		if sizes[i] > 0xFFFF+2 {
+			return nil, errors.New("invalid chapter sample size")
+		}
+		buf := make([]byte, sizes[i])
+		if _, err := r.Seek(offsets[i], io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		var title string
+		if len(buf) >= 2 {
+			n := int(binary.BigEndian.Uint16(buf[0:2]))
+			if 2+n <= len(buf) {
+				title = decodeChapterTitle(buf[2 : 2+n])
+			}
+		}
+		var delta uint32 = 0
+		if i < len(deltas) {
+			delta = deltas[i]
+		}
+		chapters = append(chapters, Mp4Chapter{
+			Title:    title,
+			Start:    float64(start) / float64(track.TimeScale),
+			Duration: float64(delta) / float64(track.TimeScale),
+		})
+		start += uint64(delta)
+	}
+	return chapters, nil
+}
+
+func decodeChapterTitle(b []byte) string {
+	if len(b) < 2 || !(b[0] == 0xFE && b[1] == 0xFF || b[0] == 0xFF && b[1] == 0xFE) {
+		return string(b)
+	}
+	units := make([]uint16, 0, len(b)/2-1)
+	for i := 2; i+1 < len(b); i += 2 {
+		if b[0] == 0xFE {
+			units = append(units, binary.BigEndian.Uint16(b[i:i+2]))
+		} else {
+			units = append(units, binary.LittleEndian.Uint16(b[i:i+2]))
+		}
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,409 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Audio sample entries of the stsd box and their codec configuration boxes.
+// ISO/IEC 14496-12 (sample entry), ISO/IEC 14496-1 (esds descriptors),
+// ISO/IEC 14496-3 (AudioSpecificConfig), ETSI TS 102 366 (dac3, dec3),
+// https://opus-codec.org/docs/opus_in_isobmff.html (dOps),
+// https://github.com/xiph/flac/blob/master/doc/isoflac.txt (dfLa),
+// https://github.com/macosforge/alac/blob/master/ALACMagicCookieDescription.txt
+
+// aacSampleRates Sampling frequencies per sampling_frequency_index.
+var aacSampleRates = []uint32{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050,
+	16000, 12000, 11025, 8000, 7350,
+}
+
+// aacObjectTypeNames Names of MPEG-4 audio object types.
+var aacObjectTypeNames = map[uint8]string{
+	1:  "AAC Main",
+	2:  "AAC-LC",
+	3:  "AAC SSR",
+	4:  "AAC LTP",
+	5:  "HE-AAC",
+	6:  "AAC Scalable",
+	23: "AAC-LD",
+	29: "HE-AACv2",
+	32: "MP1",
+	33: "MP2",
+	34: "MP3",
+	39: "AAC-ELD",
+	42: "xHE-AAC",
+}
+
+// ac3Channels Full bandwidth channels per acmod.
+var ac3Channels = []uint16{2, 1, 2, 3, 3, 4, 4, 5}
+
+// ac3SampleRates Sample rates per fscod.
+var ac3SampleRates = []uint32{48000, 44100, 32000}
+
+// mp4BitReader Read big endian bit fields.
+type mp4BitReader struct {
+	buf []byte
+	pos int // in bits
+}
+
+func (b *mp4BitReader) read(n int) (uint32, bool) {
+	if b.pos+n > len(b.buf)*8 {
+		return 0, false
+	}
+	var v uint32 = 0
+	for i := 0; i < n; i++ {
+		bit := b.buf[b.pos/8] >> (7 - b.pos%8) & 1
+		v = v<<1 | uint32(bit)
+		b.pos++
+	}
+	return v, true
+}
+
+func (b *mp4BitReader) left() int {
+	return len(b.buf)*8 - b.pos
+}
+
+// readStsd Read the first sample entry of a stsd box into the track. The
+// codec is informational, so a malformed or empty stsd leaves it unset.
+func readStsd(r io.ReadSeeker, content int64, track *Mp4Track) error {
+	if content < 16 || content > mp4MaxBoxSize {
+		return nil
+	}
+	buf := make([]byte, content)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	// version/flags(4), entry_count(4), first entry
+	size := int(binary.BigEndian.Uint32(buf[8:12]))
+	if size < 8 || 8+size > len(buf) {
+		return nil
+	}
+	parseMp4SampleEntry(string(buf[12:16]), buf[16:8+size], track)
+	return nil
+}
+
+// parseMp4SampleEntry Decode an audio sample entry and its codec
+// configuration box. Entries of other handlers only set SampleEntry.
+func parseMp4SampleEntry(typ string, entry []byte, track *Mp4Track) {
+	track.SampleEntry = typ
+	if track.Handler != "soun" || len(entry) < 28 {
+		return
+	}
+	// reserved(6), data_reference_index(2), version(2), revision(2),
+	// vendor(4), channelcount(2), samplesize(2), compression_id(2),
+	// packet_size(2), samplerate(4, 16.16 fixed point)
+	version := binary.BigEndian.Uint16(entry[8:10])
+	track.Channels = binary.BigEndian.Uint16(entry[16:18])
+	track.BitsPerSample = binary.BigEndian.Uint16(entry[18:20])
+	track.SampleRate = binary.BigEndian.Uint32(entry[24:28]) >> 16
+	children := entry[28:]
+	switch version {
+	case 1:
+		// QuickTime: samples per packet, bytes per packet, bytes per
+		// frame, bytes per sample
+		if len(children) >= 16 {
+			children = children[16:]
+		}
+	case 2:
+		// QuickTime: size of struct(4), sample rate(8, float64),
+		// channels(4), reserved(4), bits per channel(4), flags(4),
+		// bytes per packet(4), frames per packet(4)
+		if len(children) >= 36 {
+			track.SampleRate = uint32(math.Float64frombits(binary.BigEndian.Uint64(children[4:12])))
+			track.Channels = uint16(binary.BigEndian.Uint32(children[12:16]))
+			track.BitsPerSample = uint16(binary.BigEndian.Uint32(children[20:24]))
+			children = children[36:]
+		}
+	}
+
+	switch typ {
+	case "mp4a":
+		track.Codec = "AAC"
+	case "alac":
+		track.Codec = "ALAC"
+	case "Opus":
+		track.Codec = "Opus"
+		track.SampleRate = 48000
+	case "fLaC":
+		track.Codec = "FLAC"
+	case "ac-3":
+		track.Codec = "AC-3"
+	case "ec-3":
+		track.Codec = "E-AC-3"
+	case ".mp3":
+		track.Codec = "MP3"
+	case "lpcm", "sowt", "twos", "in24", "in32", "fl32", "fl64", "ipcm", "fpcm":
+		track.Codec = "PCM"
+	default:
+		track.Codec = typ
+	}
+	parseMp4CodecBoxes(children, track)
+}
+
+// parseMp4CodecBoxes Decode the codec configuration boxes of a sample entry.
+// A QuickTime 'wave' box wraps them in older files.
+func parseMp4CodecBoxes(b []byte, track *Mp4Track) {
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b[0:4]))
+		if size < 8 || size > len(b) {
+			return
+		}
+		body := b[8:size]
+		switch string(b[4:8]) {
+		case "wave":
+			parseMp4CodecBoxes(body, track)
+		case "esds":
+			if len(body) > 4 {
+				parseEsds(body[4:], track)
+			}
+		case "alac":
+			// version/flags(4), frameLength(4), compatibleVersion(1),
+			// bitDepth(1), pb(1), mb(1), kb(1), numChannels(1), maxRun(2),
+			// maxFrameBytes(4), avgBitRate(4), sampleRate(4)
+			if len(body) >= 28 {
+				track.BitsPerSample = uint16(body[9])
+				track.Channels = uint16(body[13])
+				track.SampleRate = binary.BigEndian.Uint32(body[24:28])
+			}
+		case "dOps":
+			// Version(1), OutputChannelCount(1), PreSkip(2),
+			// InputSampleRate(4), OutputGain(2), ChannelMappingFamily(1)
+			if len(body) >= 11 {
+				track.Channels = uint16(body[1])
+			}
+		case "dfLa":
+			// version/flags(4), metadata block header(4), STREAMINFO
+			if len(body) >= 8 && body[4]&0x7F == 0 {
+				if si, err := parseFlacStreamInfo(body[8:]); err == nil {
+					track.SampleRate = si.sampleRate
+					track.Channels = uint16(si.channels)
+					track.BitsPerSample = uint16(si.bitsPerSample)
+				}
+			}
+		case "dac3":
+			// fscod(2), bsid(5), bsmod(3), acmod(3), lfeon(1), bit_rate_code(5)
+			br := mp4BitReader{buf: body}
+			fscod, _ := br.read(2)
+			br.read(8)
+			acmod, _ := br.read(3)
+			lfeon, ok := br.read(1)
+			if ok {
+				track.setAc3(fscod, acmod, lfeon)
+			}
+		case "dec3":
+			// data_rate(13), num_ind_sub(3), then per independent
+			// substream fscod(2), bsid(5), reserved(1), asvc(1), bsmod(3),
+			// acmod(3), lfeon(1)
+			br := mp4BitReader{buf: body}
+			br.read(16)
+			fscod, _ := br.read(2)
+			br.read(10)
+			acmod, _ := br.read(3)
+			lfeon, ok := br.read(1)
+			if ok {
+				track.setAc3(fscod, acmod, lfeon)
+			}
+		}
+		b = b[size:]
+	}
+}
+
+func (t *Mp4Track) setAc3(fscod, acmod, lfeon uint32) {
+	if int(fscod) < len(ac3SampleRates) {
+		t.SampleRate = ac3SampleRates[fscod]
+	}
+	t.Channels = ac3Channels[acmod] + uint16(lfeon)
+}
+
+// readDescriptor Read the tag and the body of an MPEG-4 descriptor, the
+// size being coded on up to four bytes of 7 bits.
+func readDescriptor(b []byte) (uint8, []byte, []byte, bool) {
+	if len(b) < 2 {
+		return 0, nil, nil, false
+	}
+	tag := b[0]
+	size := 0
+	pos := 1
+	for i := 0; i < 4 && pos < len(b); i++ {
+		c := b[pos]
+		pos++
+		size = size<<7 | int(c&0x7F)
+		if c&0x80 == 0 {
+			break
+		}
+	}
+	if pos+size > len(b) {
+		return 0, nil, nil, false
+	}
+	return tag, b[pos : pos+size], b[pos+size:], true
+}
+
+// parseEsds Decode the ES_Descriptor of an esds box: the object type
+// indication of the DecoderConfigDescriptor and the AudioSpecificConfig of
+// the DecoderSpecificInfo.
+func parseEsds(b []byte, track *Mp4Track) {
+	tag, es, _, ok := readDescriptor(b)
+	if !ok || tag != 0x03 || len(es) < 3 {
+		return
+	}
+	// ES_ID(2), streamDependenceFlag(1), URL_Flag(1), OCRstreamFlag(1),
+	// streamPriority(5)
+	flags := es[2]
+	pos := 3
+	if flags&0x80 != 0 {
+		pos += 2
+	}
+	if flags&0x40 != 0 && pos < len(es) {
+		pos += 1 + int(es[pos])
+	}
+	if flags&0x20 != 0 {
+		pos += 2
+	}
+	if pos > len(es) {
+		return
+	}
+	for rest := es[pos:]; len(rest) > 0; {
+		tag, body, next, ok := readDescriptor(rest)
+		if !ok {
+			return
+		}
+		rest = next
+		if tag != 0x04 || len(body) < 13 {
+			continue
+		}
+		// objectTypeIndication(1), streamType(1), bufferSizeDB(3),
+		// maxBitrate(4), avgBitrate(4)
+		track.ObjectType = body[0]
+		switch body[0] {
+		case 0x66, 0x67, 0x68:
+			// MPEG-2 AAC Main, LC, SSR
+			track.AudioObjectType = body[0] - 0x65
+			track.Codec = aacObjectTypeNames[track.AudioObjectType]
+		case 0x69, 0x6B:
+			// MPEG-2 and MPEG-1 audio
+			track.Codec = "MP3"
+		case 0xA5:
+			track.Codec = "AC-3"
+		case 0xA6:
+			track.Codec = "E-AC-3"
+		case 0xA9, 0xAC:
+			track.Codec = "DTS"
+		case 0xAD:
+			track.Codec = "Opus"
+		}
+		tag, dsi, _, ok := readDescriptor(body[13:])
+		if ok && tag == 0x05 && body[0] == 0x40 {
+			parseAudioSpecificConfig(dsi, track)
+		}
+		return
+	}
+}
+
+// readAudioObjectType Read a 5 bit audio object type, escaped to 6 more
+// bits when 31.
+func readAudioObjectType(br *mp4BitReader) (uint8, bool) {
+	aot, ok := br.read(5)
+	if aot == 31 {
+		ext, ok2 := br.read(6)
+		return uint8(32 + ext), ok && ok2
+	}
+	return uint8(aot), ok
+}
+
+// readSamplingFrequency Read a 4 bit sampling frequency index, escaped to an
+// explicit 24 bit frequency when 15.
+func readSamplingFrequency(br *mp4BitReader) (uint32, bool) {
+	index, ok := br.read(4)
+	if !ok {
+		return 0, false
+	}
+	if index == 15 {
+		return br.read(24)
+	}
+	if int(index) >= len(aacSampleRates) {
+		return 0, false
+	}
+	return aacSampleRates[index], true
+}
+
+// parseAudioSpecificConfig Decode the object type, sample rate and channel
+// configuration. HE-AAC is recognised both from explicit (object type 5 or
+// 29) and backward compatible (sync extension) signalling; the sample rate
+// reported is then the SBR output rate.
+func parseAudioSpecificConfig(b []byte, track *Mp4Track) {
+	br := &mp4BitReader{buf: b}
+	aot, ok := readAudioObjectType(br)
+	if !ok {
+		return
+	}
+	sampleRate, ok := readSamplingFrequency(br)
+	if !ok {
+		return
+	}
+	channelConfig, ok := br.read(4)
+	if !ok {
+		return
+	}
+	sbr := aot == 5 || aot == 29
+	ps := aot == 29
+	if sbr {
+		if extRate, ok := readSamplingFrequency(br); ok {
+			sampleRate = extRate
+		}
+		aot, ok = readAudioObjectType(br)
+		if !ok {
+			return
+		}
+	}
+
+	// GASpecificConfig of the AAC object types, followed by the
+	// backward compatible extension
+	if !sbr && channelConfig != 0 && (aot == 1 || aot == 2 || aot == 3 || aot == 4) {
+		br.read(1) // frameLengthFlag
+		if dependsOnCoreCoder, _ := br.read(1); dependsOnCoreCoder == 1 {
+			br.read(14) // coreCoderDelay
+		}
+		br.read(1) // extensionFlag
+		if br.left() >= 16 {
+			if syncType, _ := br.read(11); syncType == 0x2B7 {
+				extAot, _ := readAudioObjectType(br)
+				if extAot == 5 {
+					if present, _ := br.read(1); present == 1 {
+						sbr = true
+						if extRate, ok := readSamplingFrequency(br); ok {
+							sampleRate = extRate
+						}
+						if br.left() >= 12 {
+							if syncType, _ := br.read(11); syncType == 0x548 {
+								present, _ := br.read(1)
+								ps = present == 1
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	track.AudioObjectType = aot
+	switch {
+	case ps:
+		track.AudioObjectType = 29
+	case sbr:
+		track.AudioObjectType = 5
+	}
+	if name, ok := aacObjectTypeNames[track.AudioObjectType]; ok {
+		track.Codec = name
+	}
+	track.SampleRate = sampleRate
+	switch {
+	case ps:
+		track.Channels = 2
+	case channelConfig >= 1 && channelConfig <= 6:
+		track.Channels = uint16(channelConfig)
+	case channelConfig == 7:
+		track.Channels = 8
+	}
+}
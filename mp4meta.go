@@ -0,0 +1,294 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// iTunes metadata is stored in moov.udta.meta.ilst, one atom per item
+// holding 'data' atoms. QuickTime user data stores text directly in
+// moov.udta as '©xxx' atoms.
+// https://developer.apple.com/library/archive/documentation/QuickTime/QTFF/Metadata/Metadata.html
+// https://developer.apple.com/library/archive/documentation/QuickTime/QTFF/QTFFChap2/qtff2.html#//apple_ref/doc/uid/TP40000939-CH204-BBCCFFGD
+
+// Mp4Metadata Tags of a mp4 file.
+type Mp4Metadata struct {
+	Title       string // ©nam
+	Artist      string // ©ART
+	Album       string // ©alb
+	AlbumArtist string // aART
+	Composer    string // ©wrt
+	Genre       string // ©gen or gnre
+	Year        string // ©day
+	Comment     string // ©cmt
+	TrackNumber int    // trkn
+	TrackTotal  int
+	DiscNumber  int // disk
+	DiscTotal   int
+	Pictures    []Picture // covr
+
+	// Items Text and integer items by atom type, e.g. ©nam, ©too, tmpo.
+	Items map[string][]string
+	// Freeform '----' items by name, e.g. iTunSMPB, iTunNORM.
+	Freeform map[string][]string
+}
+
+// Well-known types of the data atom.
+const (
+	mp4DataImplicit = 0
+	mp4DataUTF8     = 1
+	mp4DataUTF16    = 2
+	mp4DataJPEG     = 13
+	mp4DataPNG      = 14
+	mp4DataSigned   = 21
+	mp4DataUnsigned = 22
+	mp4DataBMP      = 27
+)
+
+// id3v1Genres Genres of the gnre atom, which holds the ID3v1 genre plus one.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge",
+	"Hip-Hop", "Jazz", "Metal", "New Age", "Oldies", "Other", "Pop", "R&B",
+	"Rap", "Reggae", "Rock", "Techno", "Industrial", "Alternative", "Ska",
+	"Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient",
+	"Trip-Hop", "Vocal", "Jazz+Funk", "Fusion", "Trance", "Classical",
+	"Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"AlternRock", "Bass", "Soul", "Punk", "Space", "Meditative",
+	"Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic", "Darkwave",
+	"Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream",
+	"Southern Rock", "Comedy", "Cult", "Gangsta", "Top 40", "Christian Rap",
+	"Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave",
+	"Psychadelic", "Rave", "Showtunes", "Trailer", "Lo-Fi", "Tribal",
+	"Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll",
+	"Hard Rock",
+}
+
+// freeform Return the first value of a freeform item, m may be nil.
+func (m *Mp4Metadata) freeform(name string) string {
+	if m == nil || len(m.Freeform[name]) == 0 {
+		return ""
+	}
+	return m.Freeform[name][0]
+}
+
+// item Return the first value of an item.
+func (m *Mp4Metadata) item(typ string) string {
+	if len(m.Items[typ]) == 0 {
+		return ""
+	}
+	return m.Items[typ][0]
+}
+
+// eachMp4Box Call fn for each box of b with its type and content.
+func eachMp4Box(b []byte, fn func(typ string, body []byte)) {
+	for len(b) >= 8 {
+		size := int(binary.BigEndian.Uint32(b[0:4]))
+		if size < 8 || size > len(b) {
+			return
+		}
+		fn(string(b[4:8]), b[8:size])
+		b = b[size:]
+	}
+}
+
+// readUdta Read the iTunes metadata of udta.meta.ilst, the QuickTime '©xxx'
+// user data atoms and the Nero chapters of chpl.
+func readUdta(r io.ReadSeeker, endPos int64) (*Mp4Metadata, []Mp4Chapter, error) {
+	meta := &Mp4Metadata{
+		Items:    map[string][]string{},
+		Freeform: map[string][]string{},
+	}
+	quickTime := map[string][]string{}
+	var chapters []Mp4Chapter
+
+	err := walkMp4Boxes(r, endPos, func(typ string, content int64, end int64) error {
+		if typ == "chpl" {
+			buf, err := readMp4BoxContent(r, content)
+			if err != nil {
+				return err
+			}
+			chapters = parseChpl(buf)
+		}
+		if typ == "meta" {
+			if err := skipMetaHeader(r); err != nil {
+				return err
+			}
+			return walkMp4Boxes(r, end, func(typ string, content int64, end int64) error {
+				if typ != "ilst" {
+					return nil
+				}
+				return walkMp4Boxes(r, end, func(typ string, content int64, end int64) error {
+					if content > mp4MaxBoxSize {
+						return nil
+					}
+					buf := make([]byte, content)
+					if _, err := io.ReadFull(r, buf); err != nil {
+						return err
+					}
+					meta.parseIlstItem(typ, buf)
+					return nil
+				})
+			})
+		}
+		if strings.HasPrefix(typ, "\xa9") && content <= mp4MaxBoxSize {
+			buf := make([]byte, content)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return err
+			}
+			// Mac Roman '©' is 0xA9, keys use the UTF-8 '©' like ilst
+			key := "©" + typ[1:]
+			quickTime[key] = append(quickTime[key], parseQuickTimeText(buf)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ilst items take precedence over QuickTime user data
+	for k, v := range quickTime {
+		if _, ok := meta.Items[k]; !ok && len(v) > 0 {
+			meta.Items[k] = v
+		}
+	}
+	meta.Title = meta.item("©nam")
+	meta.Artist = meta.item("©ART")
+	meta.Album = meta.item("©alb")
+	meta.AlbumArtist = meta.item("aART")
+	meta.Composer = meta.item("©wrt")
+	if g := meta.item("©gen"); g != "" {
+		meta.Genre = g
+	}
+	meta.Year = meta.item("©day")
+	meta.Comment = meta.item("©cmt")
+	return meta, chapters, nil
+}
+
+// parseIlstItem Decode the data atoms of an ilst item.
+func (m *Mp4Metadata) parseIlstItem(typ string, body []byte) {
+	// ilst atom types are Mac Roman, '©' being 0xA9
+	if strings.HasPrefix(typ, "\xa9") {
+		typ = "©" + typ[1:]
+	}
+	var name string
+	eachMp4Box(body, func(child string, b []byte) {
+		switch child {
+		case "name":
+			if len(b) >= 4 {
+				name = string(b[4:])
+			}
+		case "data":
+			// version(1), type(3), locale(4), value
+			if len(b) < 8 {
+				return
+			}
+			dataType := binary.BigEndian.Uint32(b[0:4]) & 0xFFFFFF
+			m.parseIlstData(typ, name, dataType, b[8:])
+		}
+	})
+}
+
+func (m *Mp4Metadata) parseIlstData(typ, name string, dataType uint32, value []byte) {
+	switch typ {
+	case "trkn", "disk":
+		// reserved(2), number(2), total(2)
+		if len(value) >= 6 {
+			n := int(binary.BigEndian.Uint16(value[2:4]))
+			total := int(binary.BigEndian.Uint16(value[4:6]))
+			if typ == "trkn" {
+				m.TrackNumber, m.TrackTotal = n, total
+			} else {
+				m.DiscNumber, m.DiscTotal = n, total
+			}
+		}
+		return
+	case "gnre":
+		if len(value) >= 2 {
+			g := int(binary.BigEndian.Uint16(value[0:2]))
+			if g >= 1 && g <= len(id3v1Genres) && m.Genre == "" {
+				m.Genre = id3v1Genres[g-1]
+			}
+		}
+		return
+	case "covr":
+		pic := Picture{Type: 3, Data: append([]byte(nil), value...)}
+		switch dataType {
+		case mp4DataJPEG:
+			pic.MIME = "image/jpeg"
+		case mp4DataPNG:
+			pic.MIME = "image/png"
+		case mp4DataBMP:
+			pic.MIME = "image/bmp"
+		}
+		m.Pictures = append(m.Pictures, pic)
+		return
+	}
+
+	var s string
+	switch dataType {
+	case mp4DataUTF8:
+		s = string(value)
+	case mp4DataUTF16:
+		units := make([]uint16, len(value)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(value[2*i:])
+		}
+		s = string(utf16.Decode(units))
+	case mp4DataSigned, mp4DataUnsigned, mp4DataImplicit:
+		if len(value) == 0 || len(value) > 8 {
+			return
+		}
+		var v uint64 = 0
+		for _, c := range value {
+			v = v<<8 | uint64(c)
+		}
+		if dataType == mp4DataSigned {
+			shift := 64 - 8*uint(len(value))
+			s = strconv.FormatInt(int64(v<<shift)>>shift, 10)
+		} else {
+			s = strconv.FormatUint(v, 10)
+		}
+	default:
+		return
+	}
+	if typ == "----" {
+		if name != "" {
+			m.Freeform[name] = append(m.Freeform[name], s)
+		}
+		return
+	}
+	m.Items[typ] = append(m.Items[typ], s)
+}
+
+// parseQuickTimeText Split the text entries of a QuickTime user data atom:
+// size(2), language(2), text.
+func parseQuickTimeText(b []byte) []string {
+	var texts []string
+	for len(b) >= 4 {
+		size := int(binary.BigEndian.Uint16(b[0:2]))
+		if 4+size > len(b) {
+			break
+		}
+		texts = append(texts, string(b[4:4+size]))
+		b = b[4+size:]
+	}
+	return texts
+}
+
+// skipMetaHeader Skip the version and flags of a meta box. The QuickTime
+// meta box has none and starts with its hdlr child.
+func skipMetaHeader(r io.ReadSeeker) error {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if string(buf[4:8]) == "hdlr" {
+		_, err := r.Seek(-8, io.SeekCurrent)
+		return err
+	}
+	_, err := r.Seek(-4, io.SeekCurrent)
+	return err
+}
@@ -3,6 +3,7 @@ package audioduration
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
@@ -20,6 +21,10 @@ type oggPageHead struct {
 	segTable    []uint8
 }
 
+func (oph oggPageHead) IsFirstPage() bool {
+	return oph.headerType&0x02 != 0
+}
+
 func (oph oggPageHead) IsLastPage() bool {
 	if oph.headerType>>2 == 1 {
 		return true
@@ -71,6 +76,20 @@ func parseIdentHdr(r io.ReadSeeker) (vorbisIdentHdr, error) {
 	return vih, nil
 }
 
+const flacOggHdr = "\x7FFLAC"
+
+// parseOggFlacHdr Parse the STREAMINFO embedded in the first packet of
+// Ogg-encapsulated FLAC.
+// https://xiph.org/flac/ogg_mapping.html
+func parseOggFlacHdr(packet []byte) (flacStreamInfo, error) {
+	// '\x7FFLAC'(5) + version(2) + header packets count(2) + 'fLaC'(4) +
+	// block header(4) + STREAMINFO(34)
+	if len(packet) < 51 || string(packet[9:13]) != "fLaC" || packet[13]&0x7f != 0 {
+		return flacStreamInfo{}, errors.New("invalid ogg flac header")
+	}
+	return parseFlacStreamInfo(packet[17:51])
+}
+
 // getOggBitrate Get bitrate of OGG file. Reserved.
 func getOggBitrate(vih vorbisIdentHdr) int32 {
 	var bitrate int32
@@ -86,14 +105,503 @@ func getOggBitrate(vih vorbisIdentHdr) int32 {
 	return bitrate
 }
 
+const opusHdr = "OpusHead"
+
+// opusGranuleRate Opus granule positions always count 48 kHz samples.
+const opusGranuleRate = 48000
+
+// opusIdentHdr The struct for opus identification header.
+// https://www.rfc-editor.org/rfc/rfc7845#section-5.1
+type opusIdentHdr struct {
+	version         uint8
+	channels        uint8
+	preSkip         uint16
+	inputSampleRate uint32
+	outputGain      int16
+	mappingFamily   uint8
+	streamCount     uint8
+	coupledCount    uint8
+	channelMapping  []uint8
+}
+
+// parseOpusHdr Parse the opus identification header.
+func parseOpusHdr(packet []byte) (opusIdentHdr, error) {
+	var oih opusIdentHdr
+	if len(packet) < 19 {
+		return oih, errors.New("invalid opus header")
+	}
+	oih.version = packet[8]
+	oih.channels = packet[9]
+	oih.preSkip = binary.LittleEndian.Uint16(packet[10:12])
+	oih.inputSampleRate = binary.LittleEndian.Uint32(packet[12:16])
+	oih.outputGain = int16(binary.LittleEndian.Uint16(packet[16:18]))
+	oih.mappingFamily = packet[18]
+	if oih.mappingFamily != 0 {
+		if len(packet) < 21+int(oih.channels) {
+			return oih, errors.New("invalid opus header")
+		}
+		oih.streamCount = packet[19]
+		oih.coupledCount = packet[20]
+		oih.channelMapping = packet[21 : 21+int(oih.channels)]
+	}
+	return oih, nil
+}
+
+const (
+	speexHdr    = "Speex   "
+	oggPCMHdr   = "PCM     "
+	theoraHdr   = "\x80theora"
+	skeletonHdr = "fishead\x00"
+)
+
+// parseSpeexHdr Parse sample rate and channels of the speex header.
+// https://www.speex.org/docs/manual/speex-manual/node8.html
+func parseSpeexHdr(packet []byte) (rate uint32, channels uint8, err error) {
+	if len(packet) < 52 {
+		return 0, 0, errors.New("invalid speex header")
+	}
+	rate = binary.LittleEndian.Uint32(packet[36:40])
+	channels = uint8(binary.LittleEndian.Uint32(packet[48:52]))
+	return rate, channels, nil
+}
+
+// parseOggPCMHdr Parse sample rate and channels of the OggPCM header.
+// https://wiki.xiph.org/OggPCM
+func parseOggPCMHdr(packet []byte) (rate uint32, channels uint8, err error) {
+	if len(packet) < 22 {
+		return 0, 0, errors.New("invalid ogg pcm header")
+	}
+	rate = binary.BigEndian.Uint32(packet[16:20])
+	channels = packet[21]
+	return rate, channels, nil
+}
+
+// OggInfo Stream properties of an ogg file.
+type OggInfo struct {
+	Codec      string // "vorbis", "flac", "opus", "speex" or "pcm"
+	SampleRate uint32 // rate of the granule positions
+	Channels   uint8
+	// Opus only fields
+	InputSampleRate      uint32  // sample rate of the original input, informational
+	PreSkip              uint16  // samples to discard from the decoder output
+	ChannelMappingFamily uint8   // 0 for mono/stereo, otherwise see RFC 7845
+	ChannelMapping       []uint8 // output channel to decoded channel mapping
+	Duration             float64 // total duration of all chained links
+	Links                []OggLink
+	// Comment The comment header of the first audio stream, nil if missing.
+	Comment *VorbisComment
+}
+
+// OggLink The audio stream of one link in a chained ogg file. Files that are
+// not chained have a single link.
+type OggLink struct {
+	Serial     uint32
+	Codec      string
+	SampleRate uint32
+	Channels   uint8
+	Duration   float64
+}
+
+// oggNoGranule Granule position of pages on which no packet finishes.
+const oggNoGranule = 0xFFFFFFFFFFFFFFFF
+
+// oggStream State of a logical bitstream identified by its serial number.
+type oggStream struct {
+	info        OggInfo
+	audio       bool
+	lastGranule uint64
+}
+
+// parseOggIdentPacket Identify the codec of a logical bitstream by its first
+// packet. Non-audio streams like Theora or Skeleton are reported with audio
+// false.
+func parseOggIdentPacket(data []byte) (info OggInfo, audio bool, err error) {
+	switch {
+	case len(data) >= 30 && string(data[0:7]) == identHdr:
+		var vih vorbisIdentHdr
+		vih, err = parseIdentHdr(bytes.NewReader(data[7:]))
+		if err != nil {
+			return
+		}
+		info.Codec = "vorbis"
+		info.SampleRate = vih.audioSampleRate
+		info.Channels = vih.audioChannels
+	case len(data) >= 5 && string(data[0:5]) == flacOggHdr:
+		var si flacStreamInfo
+		si, err = parseOggFlacHdr(data)
+		if err != nil {
+			return
+		}
+		info.Codec = "flac"
+		info.SampleRate = si.sampleRate
+		info.Channels = si.channels
+	case len(data) >= 8 && string(data[0:8]) == opusHdr:
+		var oih opusIdentHdr
+		oih, err = parseOpusHdr(data)
+		if err != nil {
+			return
+		}
+		info.Codec = "opus"
+		info.SampleRate = opusGranuleRate
+		info.Channels = oih.channels
+		info.InputSampleRate = oih.inputSampleRate
+		info.PreSkip = oih.preSkip
+		info.ChannelMappingFamily = oih.mappingFamily
+		info.ChannelMapping = oih.channelMapping
+	case len(data) >= 8 && string(data[0:8]) == speexHdr:
+		info.Codec = "speex"
+		info.SampleRate, info.Channels, err = parseSpeexHdr(data)
+	case len(data) >= 8 && string(data[0:8]) == oggPCMHdr:
+		info.Codec = "pcm"
+		info.SampleRate, info.Channels, err = parseOggPCMHdr(data)
+	case len(data) >= 7 && string(data[0:7]) == theoraHdr:
+		info.Codec = "theora"
+		return info, false, nil
+	case len(data) >= 8 && string(data[0:8]) == skeletonHdr:
+		info.Codec = "skeleton"
+		return info, false, nil
+	default:
+		return info, false, nil
+	}
+	return info, err == nil, err
+}
+
+// link Build the link information from the last granule position.
+func (st *oggStream) link(sn uint32) (OggLink, error) {
+	if st.info.SampleRate == 0 {
+		return OggLink{}, errors.New("invalid ogg sample rate")
+	}
+	samples := st.lastGranule
+	// Opus granule positions include the pre-skip samples
+	if samples > uint64(st.info.PreSkip) {
+		samples -= uint64(st.info.PreSkip)
+	} else {
+		samples = 0
+	}
+	return OggLink{
+		Serial:     sn,
+		Codec:      st.info.Codec,
+		SampleRate: st.info.SampleRate,
+		Channels:   st.info.Channels,
+		Duration:   float64(samples) / float64(st.info.SampleRate),
+	}, nil
+}
+
+// parseOggPageHead Parse the fixed 27 bytes of an ogg page header.
+func parseOggPageHead(headBuf []byte) oggPageHead {
+	var oggPH oggPageHead
+	oggPH.pattern = string(headBuf[0:4])
+	oggPH.version = headBuf[4]
+	oggPH.headerType = headBuf[5]
+	oggPH.granulePos = binary.LittleEndian.Uint64(headBuf[6:14])
+	oggPH.bitstreamSN = binary.LittleEndian.Uint32(headBuf[14:18])
+	oggPH.pageSeqNum = binary.LittleEndian.Uint32(headBuf[18:22])
+	oggPH.checksum = binary.LittleEndian.Uint32(headBuf[22:26])
+	oggPH.pageSegs = headBuf[26]
+	return oggPH
+}
+
+// oggCRCTable Lookup table of the ogg page checksum, a CRC32 with polynomial
+// 0x04c11db7, no reflection and zero initial value.
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// oggPageCRC Compute the checksum of a whole page, treating its checksum
+// field as zero.
+func oggPageCRC(page []byte) uint32 {
+	var crc uint32 = 0
+	for i, b := range page {
+		if i >= 22 && i < 26 {
+			b = 0
+		}
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+	return crc
+}
+
 // Ogg Calculate ogg files duration.
 func Ogg(r io.ReadSeeker) (float64, error) {
+	info, err := parseOgg(r, false)
+	if err != nil {
+		return 0, err
+	}
+	return info.Duration, nil
+}
+
+// ParseOgg Parse the identification headers, the last granule position and
+// the comment header of an ogg file. The last granule position is looked up
+// from the end of the file; the whole file is scanned only when the tail is
+// corrupt or the file is chained.
+func ParseOgg(r io.ReadSeeker) (OggInfo, error) {
+	return parseOgg(r, true)
+}
+
+// parseOgg Parse an ogg file, reading the comment header only when
+// withComment is set.
+func parseOgg(r io.ReadSeeker, withComment bool) (OggInfo, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return OggInfo{}, err
+	}
+	info, ok := parseOggTail(r)
+	if !ok {
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return info, err
+		}
+		info, err = parseOggFull(r)
+		if err != nil {
+			return info, err
+		}
+	}
+	if !withComment {
+		return info, nil
+	}
+	// A broken comment header doesn't affect the duration, so it's ignored.
+	if packet, err := readOggCommentPacket(r, start, info.Links[0].Serial); err == nil {
+		info.Comment, _ = parseOggComment(info.Codec, packet)
+	}
+	return info, nil
+}
+
+// readOggCommentPacket Assemble the second packet of a logical bitstream,
+// which may span several pages.
+func readOggCommentPacket(r io.ReadSeeker, from int64, sn uint32) ([]byte, error) {
+	if _, err := r.Seek(from, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var packet []byte
+	started := false
+	headBuf := make([]byte, 27)
+	for {
+		if _, err := io.ReadFull(r, headBuf); err != nil {
+			return nil, err
+		}
+		oggPH := parseOggPageHead(headBuf)
+		if oggPH.pattern != "OggS" {
+			return nil, errors.New("lost sync in ogg header pages")
+		}
+		page, err := readOggPageBody(r, headBuf, oggPH.pageSegs)
+		if err != nil {
+			return nil, err
+		}
+		if oggPH.bitstreamSN != sn || oggPH.IsFirstPage() {
+			continue
+		}
+		if !started && oggPH.headerType&0x01 != 0 {
+			return nil, errors.New("unexpected continued page")
+		}
+		started = true
+		data := page[27+int(oggPH.pageSegs):]
+		for _, v := range page[27 : 27+int(oggPH.pageSegs)] {
+			packet = append(packet, data[:v]...)
+			data = data[v:]
+			if v < 255 {
+				return packet, nil
+			}
+		}
+	}
+}
+
+// parseOggComment Parse the comment packet according to the codec mapping.
+func parseOggComment(codec string, packet []byte) (*VorbisComment, error) {
+	var prefix string
+	switch codec {
+	case "vorbis":
+		prefix = "\x03vorbis"
+	case "opus":
+		prefix = "OpusTags"
+	case "flac":
+		// The packet is a VORBIS_COMMENT metadata block
+		if len(packet) < 4 || packet[0]&0x7f != 4 {
+			return nil, errInvalidComment
+		}
+		return parseVorbisComment(packet[4:])
+	}
+	if len(packet) < len(prefix) || string(packet[:len(prefix)]) != prefix {
+		return nil, errInvalidComment
+	}
+	return parseVorbisComment(packet[len(prefix):])
+}
+
+// oggTailWindow How far from the end of file to look for the last page of
+// the audio stream.
+const oggTailWindow = 1 << 20
+
+// oggTailChunk Size of the blocks read backwards from the end of file.
+const oggTailChunk = 64 << 10
+
+// oggMaxPageSize header(27) + segment table(255) + data(255*255)
+const oggMaxPageSize = 27 + 255 + 255*255
+
+// parseOggTail Read the first pages for the identification headers, then scan
+// backwards from the end of file, one block at a time, for the last page of
+// the audio stream. ok is false when the result can't be determined this way.
+func parseOggTail(r io.ReadSeeker) (OggInfo, bool) {
+	var info OggInfo
+	streams := map[uint32]*oggStream{}
+	var audioSN uint32
+	found := false
+	headBuf := make([]byte, 27)
+	for {
+		if _, err := io.ReadFull(r, headBuf); err != nil {
+			return info, false
+		}
+		oggPH := parseOggPageHead(headBuf)
+		if oggPH.pattern != "OggS" || !oggPH.IsFirstPage() {
+			break
+		}
+		segTable := make([]byte, oggPH.pageSegs)
+		if _, err := io.ReadFull(r, segTable); err != nil {
+			return info, false
+		}
+		var dataSegSize int64 = 0
+		for _, v := range segTable {
+			dataSegSize += int64(v)
+		}
+		data := make([]byte, dataSegSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return info, false
+		}
+		var st oggStream
+		var err error
+		st.info, st.audio, err = parseOggIdentPacket(data)
+		if err != nil {
+			return info, false
+		}
+		streams[oggPH.bitstreamSN] = &st
+		if st.audio && !found {
+			found = true
+			audioSN = oggPH.bitstreamSN
+		}
+	}
+	if !found {
+		return info, false
+	}
+	dataStart, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return info, false
+	}
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return info, false
+	}
+	// the header of the first data page has already been read
+	limit := end - oggTailWindow
+	if limit < dataStart-27 {
+		limit = dataStart - 27
+	}
+
+	// tail holds the file content from pos, only keeping the bytes a page
+	// starting in the last block read can span.
+	var tail []byte
+	var last *oggPageHead
+	pos := end
+	for pos > limit && last == nil {
+		n := pos - limit
+		if n > oggTailChunk {
+			n = oggTailChunk
+		}
+		pos -= n
+		if len(tail) > oggMaxPageSize {
+			tail = tail[:oggMaxPageSize]
+		}
+		block := make([]byte, n, n+int64(len(tail)))
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return info, false
+		}
+		if _, err := io.ReadFull(r, block); err != nil {
+			return info, false
+		}
+		tail = append(block, tail...)
+
+		// Walk backwards over complete pages with a valid checksum. Pages of
+		// a stream not declared at the start, a first page or an earlier last
+		// page of the audio stream mean the file is chained. The rest of the
+		// block is still checked once the last page is found.
+		searchEnd := int(n) + 3
+		if searchEnd > len(tail) {
+			searchEnd = len(tail)
+		}
+		capture := []byte("OggS")
+		for i := bytes.LastIndex(tail[:searchEnd], capture); i >= 0; i = bytes.LastIndex(tail[:i], capture) {
+			if i+27 > len(tail) {
+				continue
+			}
+			oggPH := parseOggPageHead(tail[i : i+27])
+			if i+27+int(oggPH.pageSegs) > len(tail) {
+				continue
+			}
+			pageLen := 27 + int(oggPH.pageSegs)
+			for _, v := range tail[i+27 : i+27+int(oggPH.pageSegs)] {
+				pageLen += int(v)
+			}
+			if i+pageLen > len(tail) || oggPageCRC(tail[i:i+pageLen]) != oggPH.checksum {
+				continue
+			}
+			if _, ok := streams[oggPH.bitstreamSN]; !ok || oggPH.IsFirstPage() {
+				return info, false
+			}
+			if oggPH.bitstreamSN != audioSN {
+				continue
+			}
+			if last != nil {
+				if oggPH.IsLastPage() {
+					return info, false
+				}
+				continue
+			}
+			if oggPH.granulePos != oggNoGranule {
+				last = &oggPH
+			}
+		}
+	}
+	if last == nil {
+		return info, false
+	}
+	st := streams[audioSN]
+	st.lastGranule = last.granulePos
+	link, err := st.link(audioSN)
+	if err != nil {
+		return info, false
+	}
+	info = st.info
+	info.Links = []OggLink{link}
+	info.Duration = link.Duration
+	return info, true
+}
+
+// oggStreamKey Identify a logical bitstream of a chained file, as a later
+// link may reuse the serial number of an earlier one.
+type oggStreamKey struct {
+	link   int
+	serial uint32
+}
+
+// parseOggFull Read every page header of an ogg file.
+func parseOggFull(r io.ReadSeeker) (OggInfo, error) {
+	var info OggInfo
 	var err error
 	var oggPH oggPageHead
-	var vih vorbisIdentHdr
-	var samples uint64
-	var duration float64
-	seg := make([]byte, 7)
+	streams := map[oggStreamKey]*oggStream{}
+	// the audio stream of each chained link
+	links := []oggStreamKey{}
+	linkNum := -1
+	inLinkHeaders := false
+	linkHasAudio := false
 Mainloop:
 	for {
 		headBuf := make([]byte, 27)
@@ -102,16 +610,23 @@ Mainloop:
 			break
 		}
 		if string(headBuf[0:4]) != "OggS" {
+			// lost sync, search the next capture pattern
+			var cur, next int64
+			cur, err = r.Seek(-26, io.SeekCurrent)
+			if err != nil {
+				break
+			}
+			next, err = oggFindSync(r, cur)
+			if err != nil {
+				break
+			}
+			_, err = r.Seek(next, io.SeekStart)
+			if err != nil {
+				break
+			}
 			continue
 		}
-		oggPH.pattern = "OggS"
-		oggPH.version = headBuf[4]
-		oggPH.headerType = headBuf[5]
-		oggPH.granulePos = binary.LittleEndian.Uint64(headBuf[6:14])
-		oggPH.bitstreamSN = binary.LittleEndian.Uint32(headBuf[14:18])
-		oggPH.pageSeqNum = binary.LittleEndian.Uint32(headBuf[18:22])
-		oggPH.checksum = binary.LittleEndian.Uint32(headBuf[22:26])
-		oggPH.pageSegs = headBuf[26]
+		oggPH = parseOggPageHead(headBuf)
 		oggPH.segTable = []uint8{}
 		var dataSegSize int64 = 0
 		for i := uint8(0); i < oggPH.pageSegs; i++ {
@@ -123,23 +638,220 @@ Mainloop:
 			oggPH.segTable = append(oggPH.segTable, segTableItem[0])
 			dataSegSize += int64(segTableItem[0])
 		}
-		if oggPH.IsLastPage() {
-			samples = oggPH.granulePos
+		key := oggStreamKey{linkNum, oggPH.bitstreamSN}
+		if !oggPH.IsFirstPage() {
+			if st, ok := streams[key]; ok && oggPH.granulePos != oggNoGranule {
+				st.lastGranule = oggPH.granulePos
+			}
+			inLinkHeaders = false
+			r.Seek(dataSegSize, io.SeekCurrent)
+			continue
+		}
+		// All first pages of a link come before its other pages, so a first
+		// page after data pages starts a new chained link.
+		if !inLinkHeaders {
+			inLinkHeaders = true
+			linkHasAudio = false
+			linkNum++
+			key.link = linkNum
+		}
+		// The first page of a logical stream holds only its identification
+		// header packet.
+		data := make([]byte, dataSegSize)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			break
 		}
-		_, err = io.ReadFull(r, seg)
+		var st oggStream
+		st.info, st.audio, err = parseOggIdentPacket(data)
 		if err != nil {
 			break
 		}
-		if string(seg) == identHdr {
-			vih, err = parseIdentHdr(r)
+		streams[key] = &st
+		if st.audio && !linkHasAudio {
+			linkHasAudio = true
+			links = append(links, key)
 		}
-		r.Seek(-7, io.SeekCurrent)
-		r.Seek(dataSegSize, io.SeekCurrent)
 	}
 	if err != io.EOF {
-		return 0, err
+		return info, err
+	}
+	if len(links) == 0 {
+		return info, errors.New("no audio stream in ogg")
+	}
+	info = streams[links[0]].info
+	for _, key := range links {
+		link, err := streams[key].link(key.serial)
+		if err != nil {
+			return info, err
+		}
+		info.Links = append(info.Links, link)
+		info.Duration += link.Duration
+	}
+	return info, nil
+}
+
+// oggFindSync Find the offset of the next 'OggS' capture pattern at or after
+// the file offset from.
+func oggFindSync(r io.ReadSeeker, from int64) (int64, error) {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := r.Seek(from, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err := io.ReadFull(r, buf)
+		if n == 0 && err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		if i := bytes.Index(buf[:n], []byte("OggS")); i >= 0 {
+			return from + int64(i), nil
+		}
+		if err != nil {
+			return 0, io.EOF
+		}
+		// keep the last 3 bytes in case the pattern crosses the boundary
+		from += int64(n - 3)
+	}
+}
+
+// OggGap A discontinuity of page sequence numbers in a logical bitstream.
+type OggGap struct {
+	Serial   uint32
+	Offset   int64  // file offset of the page after the gap
+	Expected uint32 // expected page sequence number
+	Found    uint32 // page sequence number actually found
+}
+
+// OggVerifyResult The result of checking all pages of an ogg file.
+type OggVerifyResult struct {
+	Pages    int      // number of pages with a valid checksum
+	BadPages []int64  // file offsets of pages failing the checksum or truncated
+	Gaps     []OggGap // lost or corrupted pages, per logical bitstream
+	LostSync []int64  // file offsets of junk data where no page starts
+	Resyncs  []int64  // file offsets where sync was regained after junk data
+}
+
+// Valid Report whether no corruption was found.
+func (v OggVerifyResult) Valid() bool {
+	return len(v.BadPages) == 0 && len(v.Gaps) == 0 && len(v.LostSync) == 0
+}
+
+// VerifyOgg Check the CRC32 checksum and the sequence number of every page of
+// an ogg file.
+func VerifyOgg(r io.ReadSeeker) (OggVerifyResult, error) {
+	var res OggVerifyResult
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return res, err
+	}
+	nextSeq := map[uint32]uint32{}
+	inSync := true
+	var lastBad int64 = -1
+	headBuf := make([]byte, 27)
+	for {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return res, err
+		}
+		n, err := io.ReadFull(r, headBuf)
+		if err == io.EOF {
+			break
+		}
+		if n >= 4 && string(headBuf[0:4]) == "OggS" && err == io.ErrUnexpectedEOF {
+			if inSync {
+				res.BadPages = append(res.BadPages, pos)
+			}
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return res, err
+		}
+		if err == nil && string(headBuf[0:4]) != "OggS" {
+			err = errors.New("lost sync")
+		}
+		var page []byte
+		var oggPH oggPageHead
+		if err == nil {
+			oggPH = parseOggPageHead(headBuf)
+			page, err = readOggPageBody(r, headBuf, oggPH.pageSegs)
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				if inSync {
+					res.BadPages = append(res.BadPages, pos)
+				}
+				break
+			} else if err != nil {
+				return res, err
+			}
+			if oggPageCRC(page) != oggPH.checksum {
+				err = errors.New("checksum mismatch")
+			}
+		}
+
+		if err != nil {
+			if inSync && page != nil {
+				// Trust the page length and check the next page
+				res.BadPages = append(res.BadPages, pos)
+				lastBad = pos
+				pos += int64(len(page))
+				continue
+			}
+			if inSync {
+				inSync = false
+				res.LostSync = append(res.LostSync, pos)
+				if lastBad >= 0 {
+					// The corrupted page may have a wrong length
+					pos = lastBad
+				}
+			}
+			pos, err = oggFindSync(r, pos+1)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return res, err
+			}
+			continue
+		}
+
+		if !inSync {
+			inSync = true
+			res.Resyncs = append(res.Resyncs, pos)
+		}
+		lastBad = -1
+		res.Pages++
+		sn := oggPH.bitstreamSN
+		if expected, ok := nextSeq[sn]; ok && !oggPH.IsFirstPage() && oggPH.pageSeqNum != expected {
+			res.Gaps = append(res.Gaps, OggGap{
+				Serial:   sn,
+				Offset:   pos,
+				Expected: expected,
+				Found:    oggPH.pageSeqNum,
+			})
+		}
+		nextSeq[sn] = oggPH.pageSeqNum + 1
+		pos += int64(len(page))
+	}
+	return res, nil
+}
+
+// readOggPageBody Read the segment table and data following the page header
+// in headBuf, returning the whole page.
+func readOggPageBody(r io.Reader, headBuf []byte, pageSegs uint8) ([]byte, error) {
+	segTable := make([]byte, pageSegs)
+	if _, err := io.ReadFull(r, segTable); err != nil {
+		return nil, err
+	}
+	var dataSegSize int = 0
+	for _, v := range segTable {
+		dataSegSize += int(v)
+	}
+	page := make([]byte, 27+int(pageSegs)+dataSegSize)
+	copy(page, headBuf)
+	copy(page[27:], segTable)
+	if _, err := io.ReadFull(r, page[27+int(pageSegs):]); err != nil {
+		return nil, err
 	}
-	samplerate := vih.audioSampleRate
-	duration = float64(samples) / float64(samplerate)
-	return duration, nil
+	return page, nil
 }
@@ -0,0 +1,25 @@
+package audioduration
+
+import (
+	"errors"
+	"io"
+)
+
+// RawPCM Calculate duration of headerless PCM data from the reader position
+// to the end, given its sample rate, channels and bits per sample.
+func RawPCM(r io.ReadSeeker, sampleRate, channels, bits int) (float64, error) {
+	if sampleRate <= 0 || channels <= 0 || bits <= 0 {
+		return 0, errors.New("invalid pcm parameters")
+	}
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	frameBits := int64(channels) * int64(bits)
+	frames := (end - start) * 8 / frameBits
+	return float64(frames) / float64(sampleRate), nil
+}
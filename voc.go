@@ -0,0 +1,164 @@
+package audioduration
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Creative Voice file format
+// http://www.shikadi.net/moddingwiki/VOC_Format
+
+const vocMagic = "Creative Voice File\x1A"
+
+// vocSoundParams Parameters of the current sound data, used by continuation
+// blocks.
+type vocSoundParams struct {
+	sampleRate    float64
+	channels      int
+	bitsPerSample float64
+}
+
+// vocCodecBits Lookup bits per sample of sound data codecs.
+func vocCodecBits(codec uint16) float64 {
+	switch codec {
+	case 0x0000: // 8-bit unsigned PCM
+		return 8
+	case 0x0001: // 4-bit Creative ADPCM
+		return 4
+	case 0x0002: // 3-bit (2.6-bit) Creative ADPCM, 3 samples per byte
+		return 8.0 / 3
+	case 0x0003: // 2-bit Creative ADPCM
+		return 2
+	case 0x0004: // 16-bit signed PCM
+		return 16
+	case 0x0006, 0x0007: // A-law, u-law
+		return 8
+	}
+	return 0
+}
+
+// Voc Calculate voc files duration.
+func Voc(r io.ReadSeeker) (float64, error) {
+	buf := make([]byte, 26)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+	if string(buf[0:20]) != vocMagic {
+		return 0, errors.New("not valid voc file")
+	}
+	headerSize := binary.LittleEndian.Uint16(buf[20:22])
+	if headerSize > 26 {
+		_, err = r.Seek(int64(headerSize-26), io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var duration float64 = 0
+	var params vocSoundParams
+	// channels and sample rate of an extended block apply to the next
+	// sound data block
+	var extended *vocSoundParams
+	soundData := func(size uint32) {
+		if params.sampleRate > 0 && params.bitsPerSample > 0 && params.channels > 0 {
+			samples := float64(size) * 8 / params.bitsPerSample / float64(params.channels)
+			duration += samples / params.sampleRate
+		}
+	}
+
+	hdr := make([]byte, 4)
+	for {
+		// block type (1), block size (3)
+		_, err = io.ReadFull(r, hdr[0:1])
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		if hdr[0] == 0 { // terminator
+			break
+		}
+		_, err = io.ReadFull(r, hdr[1:4])
+		if err != nil {
+			if err == io.ErrUnexpectedEOF || err == io.EOF {
+				break
+			}
+			return 0, err
+		}
+		blockType := hdr[0]
+		blockSize := uint32(hdr[1]) | uint32(hdr[2])<<8 | uint32(hdr[3])<<16
+		// bytes of the block consumed by its fields
+		var read uint32 = 0
+
+		switch blockType {
+		case 1: // sound data: frequency divisor (1), codec (1), data
+			if blockSize < 2 {
+				return 0, errors.New("invalid voc sound data block")
+			}
+			_, err = io.ReadFull(r, buf[0:2])
+			if err != nil {
+				return 0, err
+			}
+			read = 2
+			if extended != nil {
+				params = *extended
+				extended = nil
+			} else {
+				params.sampleRate = 1000000 / float64(256-int(buf[0]))
+				params.channels = 1
+			}
+			params.bitsPerSample = vocCodecBits(uint16(buf[1]))
+			soundData(blockSize - read)
+		case 2: // sound data continuation
+			soundData(blockSize)
+		case 3: // silence: length - 1 (2), frequency divisor (1)
+			if blockSize < 3 {
+				return 0, errors.New("invalid voc silence block")
+			}
+			_, err = io.ReadFull(r, buf[0:3])
+			if err != nil {
+				return 0, err
+			}
+			read = 3
+			length := float64(binary.LittleEndian.Uint16(buf[0:2])) + 1
+			duration += length / (1000000 / float64(256-int(buf[2])))
+		case 8: // extended: time constant (2), pack (1), stereo (1)
+			if blockSize < 4 {
+				return 0, errors.New("invalid voc extended block")
+			}
+			_, err = io.ReadFull(r, buf[0:4])
+			if err != nil {
+				return 0, err
+			}
+			read = 4
+			channels := int(buf[3]) + 1
+			timeConstant := float64(binary.LittleEndian.Uint16(buf[0:2]))
+			extended = &vocSoundParams{
+				sampleRate: 256000000 / (65536 - timeConstant) / float64(channels),
+				channels:   channels,
+			}
+		case 9: // sound data: sample rate (4), bits (1), channels (1), codec (2), reserved (4), data
+			if blockSize < 12 {
+				return 0, errors.New("invalid voc sound data block")
+			}
+			_, err = io.ReadFull(r, buf[0:12])
+			if err != nil {
+				return 0, err
+			}
+			read = 12
+			extended = nil
+			params.sampleRate = float64(binary.LittleEndian.Uint32(buf[0:4]))
+			params.bitsPerSample = float64(buf[4])
+			params.channels = int(buf[5])
+			soundData(blockSize - read)
+		}
+		_, err = r.Seek(int64(blockSize-read), io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return duration, nil
+}
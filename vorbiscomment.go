@@ -0,0 +1,135 @@
+package audioduration
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Vorbis comment is the tag format of vorbis, opus, speex and flac streams.
+// https://xiph.org/vorbis/doc/v-comment.html
+
+// VorbisComment The content of a vorbis comment header.
+type VorbisComment struct {
+	Vendor string
+	// Comments Field values by upper cased field name, in file order.
+	Comments map[string][]string
+	// Pictures Cover art decoded from METADATA_BLOCK_PICTURE fields.
+	Pictures []Picture
+}
+
+// Picture An embedded picture, such as the cover art.
+type Picture struct {
+	Type        uint32 // picture type as defined by ID3v2 APIC, 3 is front cover
+	MIME        string
+	Description string
+	Width       uint32
+	Height      uint32
+	Depth       uint32 // color depth in bits per pixel
+	Colors      uint32 // number of colors for indexed-color pictures
+	Data        []byte
+}
+
+var errInvalidComment = errors.New("invalid vorbis comment")
+
+// parseVorbisComment Parse a vorbis comment, without the packet type prefix
+// of the codec.
+func parseVorbisComment(b []byte) (*VorbisComment, error) {
+	readString := func() (string, error) {
+		if len(b) < 4 {
+			return "", errInvalidComment
+		}
+		n := binary.LittleEndian.Uint32(b[0:4])
+		if uint64(n) > uint64(len(b)-4) {
+			return "", errInvalidComment
+		}
+		str := string(b[4 : 4+n])
+		b = b[4+n:]
+		return str, nil
+	}
+
+	vc := &VorbisComment{Comments: map[string][]string{}}
+	var err error
+	vc.Vendor, err = readString()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, errInvalidComment
+	}
+	count := binary.LittleEndian.Uint32(b[0:4])
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		field, err := readString()
+		if err != nil {
+			return nil, err
+		}
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToUpper(name)
+		if name == "METADATA_BLOCK_PICTURE" {
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				continue
+			}
+			if pic, err := parsePictureBlock(data); err == nil {
+				vc.Pictures = append(vc.Pictures, pic)
+			}
+			continue
+		}
+		vc.Comments[name] = append(vc.Comments[name], value)
+	}
+	return vc, nil
+}
+
+// parsePictureBlock Parse the content of a flac PICTURE metadata block.
+// https://xiph.org/flac/format.html#metadata_block_picture
+func parsePictureBlock(b []byte) (Picture, error) {
+	var pic Picture
+	errInvalid := errors.New("invalid picture block")
+	readUint32 := func() (uint32, error) {
+		if len(b) < 4 {
+			return 0, errInvalid
+		}
+		v := binary.BigEndian.Uint32(b[0:4])
+		b = b[4:]
+		return v, nil
+	}
+	readBytes := func() ([]byte, error) {
+		n, err := readUint32()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(n) > uint64(len(b)) {
+			return nil, errInvalid
+		}
+		v := b[:n]
+		b = b[n:]
+		return v, nil
+	}
+
+	var err error
+	if pic.Type, err = readUint32(); err != nil {
+		return pic, err
+	}
+	mime, err := readBytes()
+	if err != nil {
+		return pic, err
+	}
+	pic.MIME = string(mime)
+	desc, err := readBytes()
+	if err != nil {
+		return pic, err
+	}
+	pic.Description = string(desc)
+	for _, v := range []*uint32{&pic.Width, &pic.Height, &pic.Depth, &pic.Colors} {
+		if *v, err = readUint32(); err != nil {
+			return pic, err
+		}
+	}
+	pic.Data, err = readBytes()
+	return pic, err
+}
@@ -3,144 +3,559 @@ package audioduration
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
+// WAVE format codes of the fmt chunk.
+// https://www.mmsp.ece.mcgill.ca/Documents/AudioFormats/WAVE/WAVE.html
+const (
+	wavFormatPCM        uint16 = 0x0001
+	wavFormatMSADPCM    uint16 = 0x0002
+	wavFormatIEEEFloat  uint16 = 0x0003
+	wavFormatALaw       uint16 = 0x0006
+	wavFormatMuLaw      uint16 = 0x0007
+	wavFormatIMAADPCM   uint16 = 0x0011
+	wavFormatGSM610     uint16 = 0x0031
+	wavFormatMP3        uint16 = 0x0055
+	wavFormatAC3SPDIF   uint16 = 0x0092
+	wavFormatExtensible uint16 = 0xFFFE
+)
+
+// wavFormatNames Names of common format codes.
+var wavFormatNames = map[uint16]string{
+	wavFormatPCM:       "PCM",
+	wavFormatMSADPCM:   "MS ADPCM",
+	wavFormatIEEEFloat: "IEEE float",
+	wavFormatALaw:      "A-law",
+	wavFormatMuLaw:     "u-law",
+	wavFormatIMAADPCM:  "IMA ADPCM",
+	wavFormatGSM610:    "GSM 6.10",
+	0x0050:             "MPEG",
+	wavFormatMP3:       "MPEG Layer III",
+	wavFormatAC3SPDIF:  "Dolby AC-3 SPDIF",
+	0x2000:             "Dolby AC-3",
+}
+
+// wavGUIDSuffix The common suffix of KSDATAFORMAT_SUBTYPE GUIDs, the first two
+// bytes of which are the format code.
+const wavGUIDSuffix = "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"
+
+// wavSpeakerNames Speaker positions of the channel mask bits.
+var wavSpeakerNames = []string{
+	"FL", "FR", "FC", "LFE", "BL", "BR", "FLC", "FRC", "BC",
+	"SL", "SR", "TC", "TFL", "TFC", "TFR", "TBL", "TBC", "TBR",
+}
+
+// formatGUID Format a little endian encoded GUID in its canonical form.
+func formatGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:4]),
+		binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]),
+		b[8:10], b[10:16])
+}
+
+// WavInfo Stream properties of a wav file.
+type WavInfo struct {
+	Container       string // "RIFF", "RF64", "BW64" or "W64"
+	AudioFormat     uint16 // format code of the fmt chunk, 1 for PCM
+	Channels        uint16
+	SampleRate      uint32
+	ByteRate        uint32
+	BlockAlign      uint16
+	BitsPerSample   uint16
+	SamplesPerBlock uint16 // from the extended fmt chunk of compressed formats
+	// WAVE_FORMAT_EXTENSIBLE fields
+	ValidBitsPerSample uint16
+	ChannelMask        uint32
+	SubFormat          string // subformat GUID, e.g. 00000001-0000-0010-8000-00aa00389b71
+	// FormatName Name of the format, or of the subformat for extensible files.
+	FormatName   string
+	SampleFrames uint64 // number of samples per channel
+	DataSize     uint64
+	Duration     float64
+	// HeaderInconsistent The data chunk size was missing, unknown or larger
+	// than the file, typical of streaming or interrupted recordings, and was
+	// recovered from the file length.
+	HeaderInconsistent bool
+
+	// Metadata chunks
+	Info    map[string]string // LIST/INFO tags by FOURCC, e.g. INAM, IART
+	Bext    *WavBext
+	Cues    []WavCue
+	Sampler *WavSampler
+	IXML    string
+	AXML    string
+
+	subFormatCode uint16
+}
+
+// FormatCode Return the effective format code, which for
+// WAVE_FORMAT_EXTENSIBLE is taken from the subformat GUID.
+func (info WavInfo) FormatCode() uint16 {
+	if info.AudioFormat == wavFormatExtensible && info.subFormatCode != 0 {
+		return info.subFormatCode
+	}
+	return info.AudioFormat
+}
+
+// ChannelLayout Return the speaker positions of the channel mask.
+func (info WavInfo) ChannelLayout() []string {
+	layout := []string{}
+	for i, name := range wavSpeakerNames {
+		if info.ChannelMask&(1<<uint(i)) != 0 {
+			layout = append(layout, name)
+		}
+	}
+	return layout
+}
+
+// isWavUncompressed Report whether every block holds exactly one sample frame.
+func isWavUncompressed(format uint16) bool {
+	switch format {
+	case wavFormatPCM, wavFormatIEEEFloat, wavFormatALaw, wavFormatMuLaw:
+		return true
+	}
+	return false
+}
+
+// parseWavFmt Parse the content of a fmt chunk.
+func parseWavFmt(buf []byte, info *WavInfo) error {
+	// audioFormat (2), numChannels (2), sampleRate (4), bytesPerSec (4), blockAlign (2), bitsPerSample (2), optional extra params
+	if len(buf) < 14 {
+		return errors.New("invalid fmt chunk")
+	}
+	info.AudioFormat = binary.LittleEndian.Uint16(buf[0:2])
+	info.Channels = binary.LittleEndian.Uint16(buf[2:4])
+	info.SampleRate = binary.LittleEndian.Uint32(buf[4:8])
+	info.ByteRate = binary.LittleEndian.Uint32(buf[8:12])
+	info.BlockAlign = binary.LittleEndian.Uint16(buf[12:14])
+	if len(buf) >= 16 {
+		info.BitsPerSample = binary.LittleEndian.Uint16(buf[14:16])
+	}
+	// cbSize (2) and the format specific extension
+	if len(buf) < 18 {
+		return nil
+	}
+	cbSize := int(binary.LittleEndian.Uint16(buf[16:18]))
+	ext := buf[18:]
+	if len(ext) > cbSize {
+		ext = ext[:cbSize]
+	}
+	switch info.AudioFormat {
+	case wavFormatExtensible:
+		// wValidBitsPerSample (2), dwChannelMask (4), SubFormat (16)
+		if len(ext) < 22 {
+			return errors.New("invalid extensible fmt chunk")
+		}
+		info.ValidBitsPerSample = binary.LittleEndian.Uint16(ext[0:2])
+		info.ChannelMask = binary.LittleEndian.Uint32(ext[2:6])
+		info.SubFormat = formatGUID(ext[6:22])
+		if string(ext[8:22]) == wavGUIDSuffix {
+			info.subFormatCode = binary.LittleEndian.Uint16(ext[6:8])
+		}
+	case wavFormatMSADPCM, wavFormatIMAADPCM, wavFormatGSM610:
+		// wSamplesPerBlock (2)
+		if len(ext) >= 2 {
+			info.SamplesPerBlock = binary.LittleEndian.Uint16(ext[0:2])
+		}
+	}
+	return nil
+}
+
+// computeWavDuration Compute the sample frames and duration. Uncompressed
+// formats use the block alignment; compressed formats prefer the fact chunk
+// sample count, then samples per block, then byteRate (e.g. MP3 in WAV).
+func computeWavDuration(info *WavInfo, factSamples uint64, hasFact bool) {
+	switch {
+	case isWavUncompressed(info.FormatCode()) && info.BlockAlign != 0:
+		info.SampleFrames = info.DataSize / uint64(info.BlockAlign)
+	case hasFact && !isWavUncompressed(info.FormatCode()):
+		info.SampleFrames = factSamples
+	case info.SamplesPerBlock != 0 && info.BlockAlign != 0:
+		blocks := info.DataSize / uint64(info.BlockAlign)
+		rem := info.DataSize % uint64(info.BlockAlign)
+		info.SampleFrames = blocks*uint64(info.SamplesPerBlock) +
+			rem*uint64(info.SamplesPerBlock)/uint64(info.BlockAlign)
+	}
+	if info.SampleFrames != 0 && info.SampleRate != 0 {
+		info.Duration = float64(info.SampleFrames) / float64(info.SampleRate)
+	} else if info.ByteRate != 0 {
+		info.Duration = float64(info.DataSize) / float64(info.ByteRate)
+	}
+}
+
 // Wav Calculate wav files duration.
-// It parses RIFF/WAVE with fmt and data chunks. PCM and non-PCM
-// with block alignment are supported via byteRate/blockAlign.
 func Wav(r io.ReadSeeker) (float64, error) {
-	buf4 := make([]byte, 4)
-	buf2 := make([]byte, 2)
-
-	// RIFF header
-	_, err := io.ReadFull(r, buf4)
+	info, err := parseWav(r, false)
 	if err != nil {
 		return 0, err
 	}
-	if string(buf4) != "RIFF" {
-		return 0, errors.New("not RIFF")
+	return info.Duration, nil
+}
+
+// Sony Wave64 uses GUIDs as chunk IDs. The GUIDs of the standard chunks are
+// the FOURCC followed by a common suffix.
+// https://www.ambisonia.com/Members/mleese/sony_wave64.pdf
+const (
+	w64RiffSuffix  = "\x2e\x91\xcf\x11\xa5\xd6\x28\xdb\x04\xc1\x00\x00"
+	w64ChunkSuffix = "\xf3\xac\xd3\x11\x8c\xd1\x00\xc0\x4f\x8e\xdb\x8a"
+)
+
+// rf64Unknown The 32-bit chunk size telling to look up the ds64 chunk.
+const rf64Unknown = 0xFFFFFFFF
+
+// wavChunkReader Read chunk headers of RIFF (and RF64) or Wave64 files.
+type wavChunkReader struct {
+	r   io.ReadSeeker
+	w64 bool
+}
+
+// next Read the next chunk header, returning the chunk ID as a FOURCC (or
+// the raw GUID for non-standard Wave64 chunks) and the content size.
+func (cr wavChunkReader) next() (string, uint64, error) {
+	if cr.w64 {
+		buf := make([]byte, 24)
+		if _, err := io.ReadFull(cr.r, buf); err != nil {
+			return "", 0, err
+		}
+		id := string(buf[0:16])
+		if string(buf[4:16]) == w64ChunkSuffix || string(buf[4:16]) == w64RiffSuffix {
+			id = string(buf[0:4])
+		}
+		size := binary.LittleEndian.Uint64(buf[16:24])
+		if size < 24 {
+			return "", 0, errors.New("invalid wave64 chunk size")
+		}
+		return id, size - 24, nil
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		return "", 0, err
 	}
-	// skip RIFF size (4 bytes)
-	_, err = io.ReadFull(r, buf4)
+	return string(buf[0:4]), uint64(binary.LittleEndian.Uint32(buf[4:8])), nil
+}
+
+// chunkFollows Report whether a valid chunk header, with a printable FOURCC
+// and a size within the avail bytes left, starts at the current position.
+// The position is left unchanged.
+func (cr wavChunkReader) chunkFollows(avail uint64) (bool, error) {
+	pos, err := cr.r.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return 0, err
+		return false, err
+	}
+	id, size, err := cr.next()
+	valid := err == nil
+	if valid {
+		headerLen := uint64(8)
+		if cr.w64 {
+			headerLen = 24
+		}
+		valid = avail >= headerLen && size <= avail-headerLen
+		for _, c := range []byte(id[0:4]) {
+			if c < 0x20 || c > 0x7e {
+				valid = false
+			}
+		}
+	}
+	if _, err := cr.r.Seek(pos, io.SeekStart); err != nil {
+		return false, err
+	}
+	return valid, nil
+}
+
+// skipPadding Skip the padding after a chunk content of the given size.
+// RIFF chunks are word aligned and Wave64 chunks are 8 bytes aligned.
+func (cr wavChunkReader) skipPadding(size uint64) error {
+	align := uint64(2)
+	if cr.w64 {
+		align = 8
+	}
+	if pad := (align - size%align) % align; pad > 0 {
+		_, err := cr.r.Seek(int64(pad), io.SeekCurrent)
+		return err
+	}
+	return nil
+}
+
+// ds64Chunk The RF64/BW64 chunk holding 64-bit sizes.
+// https://tech.ebu.ch/docs/tech/tech3306v1_1.pdf
+type ds64Chunk struct {
+	riffSize    uint64
+	dataSize    uint64
+	sampleCount uint64
+	table       map[string]uint64
+}
+
+func parseDs64(buf []byte) (ds64Chunk, error) {
+	var ds ds64Chunk
+	if len(buf) < 28 {
+		return ds, errors.New("invalid ds64 chunk")
+	}
+	ds.riffSize = binary.LittleEndian.Uint64(buf[0:8])
+	ds.dataSize = binary.LittleEndian.Uint64(buf[8:16])
+	ds.sampleCount = binary.LittleEndian.Uint64(buf[16:24])
+	tableLen := binary.LittleEndian.Uint32(buf[24:28])
+	ds.table = map[string]uint64{}
+	for i, pos := uint32(0), 28; i < tableLen && pos+12 <= len(buf); i, pos = i+1, pos+12 {
+		ds.table[string(buf[pos:pos+4])] = binary.LittleEndian.Uint64(buf[pos+4 : pos+12])
 	}
-	// WAVE
-	_, err = io.ReadFull(r, buf4)
+	return ds, nil
+}
+
+// wavMaxMetaSize Upper limit of metadata chunks read into memory.
+const wavMaxMetaSize = 64 << 20
+
+// wavMaxHeaderSize Upper limit of the ds64, fmt and fact chunks.
+const wavMaxHeaderSize = 64 << 10
+
+// ParseWav Parse RIFF/WAVE, RF64/BW64 and Sony Wave64 with fmt, fact, data
+// and metadata chunks. PCM uses the block alignment; compressed formats use
+// the fact chunk or samples per block, and fall back to byteRate. Malformed or
+// truncated metadata chunks are ignored.
+func ParseWav(r io.ReadSeeker) (WavInfo, error) {
+	return parseWav(r, true)
+}
+
+// parseWav Parse a wav file, reading the metadata chunks only when
+// withMetadata is set. Otherwise the walk stops once the duration is known.
+func parseWav(r io.ReadSeeker, withMetadata bool) (WavInfo, error) {
+	var info WavInfo
+	buf := make([]byte, 12)
+
+	// RIFF header
+	_, err := io.ReadFull(r, buf)
 	if err != nil {
-		return 0, err
+		return info, err
 	}
-	if string(buf4) != "WAVE" {
-		return 0, errors.New("not WAVE")
+	cr := wavChunkReader{r: r}
+	switch string(buf[0:4]) {
+	case "RIFF", "RF64", "BW64":
+		info.Container = string(buf[0:4])
+		// WAVE after RIFF size (4 bytes)
+		if string(buf[8:12]) != "WAVE" {
+			return info, errors.New("not WAVE")
+		}
+	case "riff":
+		// riff GUID (16), file size (8), wave GUID (16)
+		rest := make([]byte, 28)
+		_, err = io.ReadFull(r, rest)
+		if err != nil {
+			return info, err
+		}
+		hdr := append(buf, rest...)
+		if string(hdr[4:16]) != w64RiffSuffix {
+			return info, errors.New("not RIFF")
+		}
+		if string(hdr[24:28]) != "wave" || string(hdr[28:40]) != w64ChunkSuffix {
+			return info, errors.New("not WAVE")
+		}
+		info.Container = "W64"
+		cr.w64 = true
+	default:
+		return info, errors.New("not RIFF")
 	}
 
-	//var sampleRate uint32 = 0
-	//var blockAlign uint16 = 0
-	var bytesPerSec uint32 = 0
-	var dataSize uint32 = 0
+	hasFmt := false
+	hasData := false
+	hasFact := false
+	var factSamples uint64 = 0
+	var ds64 *ds64Chunk
+	adtl := wavAdtl{
+		labels:  map[uint32]string{},
+		notes:   map[uint32]string{},
+		lengths: map[uint32]uint64{},
+	}
 
 	// iterate chunks
 loop:
 	for {
-		// chunk id
-		_, err = io.ReadFull(r, buf4)
+		chunkID, chunkSize, err := cr.next()
 		if err != nil {
-			if err == io.EOF {
+			// a truncated trailing chunk header is ignored
+			if err == io.EOF || (err == io.ErrUnexpectedEOF && hasFmt && hasData) {
 				break
 			}
-			return 0, err
+			return info, err
 		}
-		chunkID := string(buf4)
-		// chunk size
-		_, err = io.ReadFull(r, buf4)
-		if err != nil {
-			return 0, err
+		// RF64 keeps sizes above 4 GB in the ds64 chunk
+		if ds64 != nil && chunkSize == rf64Unknown {
+			if chunkID == "data" {
+				chunkSize = ds64.dataSize
+			} else if size, ok := ds64.table[chunkID]; ok {
+				chunkSize = size
+			}
+		}
+		// Wave64 and ds64 sizes are 64-bit, chunks are skipped with Seek
+		if chunkSize > math.MaxInt64 {
+			return info, errors.New("invalid wav chunk size")
+		}
+
+		if (chunkID == "ds64" || chunkID == "fmt " || chunkID == "fact") && chunkSize > wavMaxHeaderSize {
+			return info, errors.New("wav header chunk too large")
 		}
-		chunkSize := binary.LittleEndian.Uint32(buf4)
 
 		switch chunkID {
-		case "fmt ":
-			// audioFormat (2), numChannels (2), sampleRate (4), bytesPerSec (4), blockAlign (2), bitsPerSample (2), optional extra params
-			_, err = io.ReadFull(r, buf2)
+		case "ds64":
+			dsBuf := make([]byte, chunkSize)
+			_, err = io.ReadFull(r, dsBuf)
+			if err != nil {
+				return info, err
+			}
+			ds, err := parseDs64(dsBuf)
 			if err != nil {
-				return 0, err
+				return info, err
 			}
-			// audioFormat := binary.LittleEndian.Uint16(buf2)
-			_, err = io.ReadFull(r, buf2) // numChannels
+			ds64 = &ds
+		case "fmt ":
+			fmtBuf := make([]byte, chunkSize)
+			_, err = io.ReadFull(r, fmtBuf)
 			if err != nil {
-				return 0, err
+				return info, err
 			}
-			_, err = io.ReadFull(r, buf4) // sampleRate
+			err = parseWavFmt(fmtBuf, &info)
 			if err != nil {
-				return 0, err
+				return info, err
+			}
+			info.FormatName = wavFormatNames[info.FormatCode()]
+			hasFmt = true
+			if hasData && !withMetadata {
+				break loop
 			}
-			// sampleRate = binary.LittleEndian.Uint32(buf4)
-			_, err = io.ReadFull(r, buf4) // byteRate
+		case "fact":
+			// dwSampleLength (4)
+			factBuf := make([]byte, chunkSize)
+			_, err = io.ReadFull(r, factBuf)
 			if err != nil {
-				return 0, err
+				return info, err
 			}
-			bytesPerSec = binary.LittleEndian.Uint32(buf4)
-			_, err = io.ReadFull(r, buf2) // blockAlign
+			if len(factBuf) >= 4 {
+				hasFact = true
+				factSamples = uint64(binary.LittleEndian.Uint32(factBuf[0:4]))
+				if ds64 != nil && factSamples == rf64Unknown {
+					factSamples = ds64.sampleCount
+				}
+			}
+		case "data":
+			dataStart, err := r.Seek(0, io.SeekCurrent)
 			if err != nil {
-				return 0, err
+				return info, err
 			}
-			// blockAlign = binary.LittleEndian.Uint16(buf2)
-			// bitsPerSample
-			_, err = io.ReadFull(r, buf2)
+			fileEnd, err := r.Seek(0, io.SeekEnd)
 			if err != nil {
-				return 0, err
+				return info, err
+			}
+			if _, err := r.Seek(dataStart, io.SeekStart); err != nil {
+				return info, err
 			}
-			// Skip any remaining bytes in fmt chunk
-			fmtRead := uint32(2 + 2 + 4 + 4 + 2 + 2)
-			if chunkSize > fmtRead {
-				_, err = r.Seek(int64(chunkSize-fmtRead), io.SeekCurrent)
+			avail := uint64(fileEnd - dataStart)
+			streaming := chunkSize == 0 && avail > 0
+			if streaming {
+				// An empty data chunk may be followed by metadata chunks
+				follows, err := cr.chunkFollows(avail)
 				if err != nil {
-					return 0, err
+					return info, err
 				}
+				streaming = !follows
 			}
-			if dataSize != 0 {
+			if streaming || (!cr.w64 && chunkSize == rf64Unknown) || chunkSize > avail {
+				// The data runs until the end of file
+				info.HeaderInconsistent = true
+				info.DataSize = avail
+				hasData = true
 				break loop
 			}
-		case "data":
-			dataSize = chunkSize
-			if bytesPerSec != 0 {
+			info.DataSize = chunkSize
+			hasData = true
+			if hasFmt && (hasFact || isWavUncompressed(info.FormatCode())) && !withMetadata {
 				break loop
 			}
-			// Skip actual data
+			// Skip actual data, the fact and metadata chunks may follow
 			if chunkSize > 0 {
 				_, err = r.Seek(int64(chunkSize), io.SeekCurrent)
 				if err != nil {
-					return 0, err
+					return info, err
+				}
+			}
+		case "LIST", "bext", "cue ", "smpl", "iXML", "axml":
+			if !withMetadata || chunkSize > wavMaxMetaSize {
+				// skip like an unknown chunk
+				_, err = r.Seek(int64(chunkSize), io.SeekCurrent)
+				if err != nil {
+					return info, err
+				}
+				break
+			}
+			metaBuf := make([]byte, chunkSize)
+			_, err = io.ReadFull(r, metaBuf)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// a truncated trailing chunk holds no metadata
+				break loop
+			}
+			if err != nil {
+				return info, err
+			}
+			// malformed chunks are left out of the metadata
+			switch chunkID {
+			case "LIST":
+				parseWavList(metaBuf, &info, &adtl)
+			case "bext":
+				if bext, err := parseWavBext(metaBuf); err == nil {
+					info.Bext = bext
+				}
+			case "cue ":
+				if cues, err := parseWavCue(metaBuf); err == nil {
+					info.Cues = cues
 				}
+			case "smpl":
+				if sampler, err := parseWavSmpl(metaBuf); err == nil {
+					info.Sampler = sampler
+				}
+			case "iXML":
+				info.IXML = wavString(metaBuf)
+			case "axml":
+				info.AXML = wavString(metaBuf)
 			}
 		default:
 			// skip unknown chunk
-			// chunks are word aligned; sizes include data only
 			if chunkSize > 0 {
 				// Some chunks can be huge; use Seek
 				_, err = r.Seek(int64(chunkSize), io.SeekCurrent)
 				if err != nil {
-					return 0, err
+					return info, err
 				}
 			}
 		}
 
-		// Handle padding byte if chunk size is odd (RIFF word alignment)
-		if chunkSize%2 == 1 {
-			_, err = io.ReadFull(r, buf4[:1])
-			if err != nil {
-				return 0, err
-			}
+		err = cr.skipPadding(chunkSize)
+		if err != nil {
+			return info, err
 		}
 	}
 
-	if bytesPerSec == 0 {
-		return 0, errors.New("missing fmt chunk")
+	if !hasFmt {
+		return info, errors.New("missing fmt chunk")
 	}
-	if dataSize == 0 {
-		return 0, errors.New("missing data chunk")
+	if !hasData {
+		return info, errors.New("missing data chunk")
 	}
-
-	return float64(dataSize) / float64(bytesPerSec), nil
+	if info.HeaderInconsistent && info.BlockAlign != 0 {
+		info.DataSize -= info.DataSize % uint64(info.BlockAlign)
+	}
+	computeWavDuration(&info, factSamples, hasFact)
+	if info.SampleFrames == 0 && info.ByteRate == 0 {
+		return info, errors.New("invalid fmt chunk")
+	}
+	for i := range info.Cues {
+		c := &info.Cues[i]
+		c.Label = adtl.labels[c.ID]
+		c.Note = adtl.notes[c.ID]
+		c.Length = adtl.lengths[c.ID]
+		if info.SampleRate != 0 {
+			c.Time = float64(c.Position) / float64(info.SampleRate)
+		}
+	}
+	return info, nil
 }
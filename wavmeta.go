@@ -0,0 +1,188 @@
+package audioduration
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Metadata chunks of wav files.
+// https://www.mmsp.ece.mcgill.ca/Documents/AudioFormats/WAVE/Docs/riffmci.pdf
+// https://tech.ebu.ch/docs/tech/tech3285.pdf
+
+// WavBext The Broadcast Wave extension chunk.
+type WavBext struct {
+	Description         string
+	Originator          string
+	OriginatorReference string
+	OriginationDate     string // yyyy-mm-dd
+	OriginationTime     string // hh-mm-ss
+	TimeReference       uint64 // first sample count since midnight
+	Version             uint16
+	UMID                []byte
+	// Loudness values of version 2, in LUFS/LU/dBTP
+	LoudnessValue        float64
+	LoudnessRange        float64
+	MaxTruePeakLevel     float64
+	MaxMomentaryLoudness float64
+	MaxShortTermLoudness float64
+	CodingHistory        string
+}
+
+// WavCue A cue point, with its label and note from the LIST/adtl chunk.
+type WavCue struct {
+	ID       uint32
+	Position uint64  // sample offset in the data chunk
+	Length   uint64  // sample length of a region (ltxt), 0 for markers
+	Time     float64 // position in seconds
+	Label    string
+	Note     string
+}
+
+// WavSampler The content of the smpl chunk.
+type WavSampler struct {
+	Manufacturer      uint32
+	Product           uint32
+	SamplePeriod      uint32 // nanoseconds per sample
+	MIDIUnityNote     uint32
+	MIDIPitchFraction uint32
+	Loops             []WavLoop
+}
+
+// WavLoop A sample loop of the smpl chunk.
+type WavLoop struct {
+	CuePointID uint32
+	Type       uint32 // 0 forward, 1 alternating, 2 backward
+	Start      uint32 // sample offset
+	End        uint32 // sample offset
+	Fraction   uint32
+	PlayCount  uint32 // 0 for infinite
+}
+
+// wavString Decode a fixed size or zero terminated string.
+func wavString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func parseWavBext(buf []byte) (*WavBext, error) {
+	if len(buf) < 602 {
+		return nil, errors.New("invalid bext chunk")
+	}
+	loudness := func(off int) float64 {
+		return float64(int16(binary.LittleEndian.Uint16(buf[off:off+2]))) / 100
+	}
+	b := &WavBext{
+		Description:         wavString(buf[0:256]),
+		Originator:          wavString(buf[256:288]),
+		OriginatorReference: wavString(buf[288:320]),
+		OriginationDate:     wavString(buf[320:330]),
+		OriginationTime:     wavString(buf[330:338]),
+		TimeReference: uint64(binary.LittleEndian.Uint32(buf[338:342])) |
+			uint64(binary.LittleEndian.Uint32(buf[342:346]))<<32,
+		Version:       binary.LittleEndian.Uint16(buf[346:348]),
+		UMID:          buf[348:412],
+		CodingHistory: wavString(buf[602:]),
+	}
+	if b.Version >= 2 {
+		b.LoudnessValue = loudness(412)
+		b.LoudnessRange = loudness(414)
+		b.MaxTruePeakLevel = loudness(416)
+		b.MaxMomentaryLoudness = loudness(418)
+		b.MaxShortTermLoudness = loudness(420)
+	}
+	return b, nil
+}
+
+func parseWavCue(buf []byte) ([]WavCue, error) {
+	if len(buf) < 4 {
+		return nil, errors.New("invalid cue chunk")
+	}
+	count := binary.LittleEndian.Uint32(buf[0:4])
+	cues := []WavCue{}
+	// ID (4), Position (4), DataChunkID (4), ChunkStart (4), BlockStart (4), SampleOffset (4)
+	for i, pos := uint32(0), 4; i < count && pos+24 <= len(buf); i, pos = i+1, pos+24 {
+		cues = append(cues, WavCue{
+			ID:       binary.LittleEndian.Uint32(buf[pos : pos+4]),
+			Position: uint64(binary.LittleEndian.Uint32(buf[pos+20 : pos+24])),
+		})
+	}
+	return cues, nil
+}
+
+func parseWavSmpl(buf []byte) (*WavSampler, error) {
+	if len(buf) < 36 {
+		return nil, errors.New("invalid smpl chunk")
+	}
+	s := &WavSampler{
+		Manufacturer:      binary.LittleEndian.Uint32(buf[0:4]),
+		Product:           binary.LittleEndian.Uint32(buf[4:8]),
+		SamplePeriod:      binary.LittleEndian.Uint32(buf[8:12]),
+		MIDIUnityNote:     binary.LittleEndian.Uint32(buf[12:16]),
+		MIDIPitchFraction: binary.LittleEndian.Uint32(buf[16:20]),
+		Loops:             []WavLoop{},
+	}
+	count := binary.LittleEndian.Uint32(buf[28:32])
+	for i, pos := uint32(0), 36; i < count && pos+24 <= len(buf); i, pos = i+1, pos+24 {
+		s.Loops = append(s.Loops, WavLoop{
+			CuePointID: binary.LittleEndian.Uint32(buf[pos : pos+4]),
+			Type:       binary.LittleEndian.Uint32(buf[pos+4 : pos+8]),
+			Start:      binary.LittleEndian.Uint32(buf[pos+8 : pos+12]),
+			End:        binary.LittleEndian.Uint32(buf[pos+12 : pos+16]),
+			Fraction:   binary.LittleEndian.Uint32(buf[pos+16 : pos+20]),
+			PlayCount:  binary.LittleEndian.Uint32(buf[pos+20 : pos+24]),
+		})
+	}
+	return s, nil
+}
+
+// wavAdtl Labels, notes and region lengths of cue points from LIST/adtl.
+type wavAdtl struct {
+	labels  map[uint32]string
+	notes   map[uint32]string
+	lengths map[uint32]uint64
+}
+
+// parseWavList Parse the subchunks of a LIST chunk of type INFO or adtl.
+func parseWavList(buf []byte, info *WavInfo, adtl *wavAdtl) {
+	if len(buf) < 4 {
+		return
+	}
+	listType := string(buf[0:4])
+	for pos := 4; pos+8 <= len(buf); {
+		id := string(buf[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(buf[pos+4 : pos+8]))
+		pos += 8
+		if size > len(buf)-pos {
+			break
+		}
+		content := buf[pos : pos+size]
+		pos += size + size%2
+
+		switch listType {
+		case "INFO":
+			if info.Info == nil {
+				info.Info = map[string]string{}
+			}
+			info.Info[id] = wavString(content)
+		case "adtl":
+			if len(content) < 4 {
+				continue
+			}
+			cueID := binary.LittleEndian.Uint32(content[0:4])
+			switch id {
+			case "labl":
+				adtl.labels[cueID] = wavString(content[4:])
+			case "note":
+				adtl.notes[cueID] = wavString(content[4:])
+			case "ltxt":
+				// sample length (4), purpose (4), country, language, dialect, code page (2 each)
+				if len(content) >= 8 {
+					adtl.lengths[cueID] = uint64(binary.LittleEndian.Uint32(content[4:8]))
+				}
+			}
+		}
+	}
+}